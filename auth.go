@@ -0,0 +1,126 @@
+package melody
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Authenticator authenticates requests before they are upgraded, set it with
+// Melody.Authenticator. The returned principal is available from
+// Session.Principal. Returning an error rejects the request, with the status
+// of an *AuthError or http.StatusUnauthorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal any, err error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (principal any, err error)
+
+// Authenticate calls fn(r).
+func (fn AuthenticatorFunc) Authenticate(r *http.Request) (any, error) {
+	return fn(r)
+}
+
+// MessageAuthenticator authenticates sessions with the first message they send,
+// set it with Melody.MessageAuthenticator. It is used for sessions that were not
+// given a principal by the Authenticator. Sessions that do not send a message that
+// authenticates within Config.AuthTimeout are closed with ClosePolicyViolation.
+// HandleConnect fires after the session has been authenticated.
+type MessageAuthenticator interface {
+	AuthenticateMessage(s *Session, msg []byte) (principal any, err error)
+}
+
+// MessageAuthenticatorFunc adapts a function to the MessageAuthenticator interface.
+type MessageAuthenticatorFunc func(s *Session, msg []byte) (principal any, err error)
+
+// AuthenticateMessage calls fn(s, msg).
+func (fn MessageAuthenticatorFunc) AuthenticateMessage(s *Session, msg []byte) (any, error) {
+	return fn(s, msg)
+}
+
+// AuthError rejects a request with an HTTP status.
+type AuthError struct {
+	Status  int    // HTTP status, defaults to http.StatusUnauthorized.
+	Message string // Response body, defaults to the status text.
+}
+
+func (e *AuthError) Error() string {
+	return "melody: authentication failed: " + e.message()
+}
+
+func (e *AuthError) status() int {
+	if e.Status == 0 {
+		return http.StatusUnauthorized
+	}
+	return e.Status
+}
+
+func (e *AuthError) message() string {
+	if e.Message == "" {
+		return http.StatusText(e.status())
+	}
+	return e.Message
+}
+
+// authenticate runs the Authenticator and writes an error response if it rejects r.
+func (m *Melody) authenticate(w http.ResponseWriter, r *http.Request) (any, error) {
+	if m.Authenticator == nil {
+		return nil, nil
+	}
+
+	principal, err := m.Authenticator.Authenticate(r)
+
+	if err != nil {
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			authErr = &AuthError{}
+		}
+		http.Error(w, authErr.message(), authErr.status())
+		return nil, err
+	}
+
+	return principal, nil
+}
+
+// authenticateMessage authenticates s with its first message if it has no principal yet.
+func (s *Session) authenticateMessage() error {
+	m := s.melody
+
+	if m.MessageAuthenticator == nil || s.principal != nil {
+		return nil
+	}
+
+	s.conn.SetReadLimit(m.Config.MaxMessageSize)
+	s.conn.SetReadDeadline(m.now().Add(m.Config.AuthTimeout))
+
+	_, msg, err := s.conn.ReadMessage()
+
+	if err == nil {
+		s.principal, err = m.MessageAuthenticator.AuthenticateMessage(s, msg)
+	}
+
+	if err == nil && s.principal == nil {
+		err = ErrUnauthenticated
+	}
+
+	if err != nil {
+		s.terminate(ClosePolicyViolation, "authentication failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// Principal returns the principal the session was authenticated as, or nil.
+func (s *Session) Principal() any {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.principal
+}
+
+// PrincipalAs returns the principal of s as a T.
+func PrincipalAs[T any](s *Session) (T, bool) {
+	principal, ok := s.Principal().(T)
+	return principal, ok
+}
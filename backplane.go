@@ -0,0 +1,84 @@
+package melody
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// BackplaneMessage is a broadcast relayed between melody instances.
+type BackplaneMessage struct {
+	Origin   string // Node that published the message.
+	Type     int    // TextMessage or BinaryMessage.
+	Payload  []byte // Message payload.
+	Room     string // Room the message is scoped to, empty for all sessions.
+	Session  string // ID of the session the message is addressed to, empty for broadcasts.
+	Key      string // Coalescing key, see Session.WriteKeyed.
+	Compress *bool  // Compression override, nil to use Config.CompressionThreshold.
+}
+
+// Backplane relays broadcasts between melody instances, typically running
+// in different processes behind a load balancer. Every instance attached
+// to the same backplane receives every published message, including the
+// instance that published it; melody drops its own messages on receipt.
+type Backplane interface {
+	// Publish sends msg to every subscriber.
+	Publish(msg *BackplaneMessage) error
+	// Subscribe calls fn for every published message until cancel is called.
+	Subscribe(fn func(*BackplaneMessage)) (cancel func(), err error)
+}
+
+// MemoryBackplane is a Backplane connecting melody instances in the same process.
+type MemoryBackplane struct {
+	mu   sync.RWMutex
+	subs map[int]func(*BackplaneMessage)
+	next int
+}
+
+// NewMemoryBackplane creates a new in-memory backplane.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subs: make(map[int]func(*BackplaneMessage)),
+	}
+}
+
+// Publish calls every subscriber with msg.
+func (b *MemoryBackplane) Publish(msg *BackplaneMessage) error {
+	b.mu.RLock()
+	subs := make([]func(*BackplaneMessage), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mu.RUnlock()
+
+	for _, fn := range subs {
+		fn(msg)
+	}
+
+	return nil
+}
+
+// Subscribe registers fn to be called for every published message.
+func (b *MemoryBackplane) Subscribe(fn func(*BackplaneMessage)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, id)
+	}, nil
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
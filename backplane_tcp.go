@@ -0,0 +1,237 @@
+package melody
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits for relaying to a TCPBackplane client, clients that fall behind are disconnected.
+const (
+	tcpBackplaneQueueSize = 256              // Messages queued for a client.
+	tcpBackplaneWriteWait = 10 * time.Second // Time allowed to write a message to a client.
+)
+
+// TCPBackplaneServer relays backplane messages between TCPBackplane clients.
+// It is a reference implementation intended for tests and small deployments.
+type TCPBackplaneServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]chan []byte
+}
+
+// ListenTCPBackplane starts a relay server listening on addr, e.g. "127.0.0.1:0".
+func ListenTCPBackplane(addr string) (*TCPBackplaneServer, error) {
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TCPBackplaneServer{
+		ln:    ln,
+		conns: make(map[net.Conn]chan []byte),
+	}
+
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *TCPBackplaneServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close stops the server and disconnects all clients.
+func (s *TCPBackplaneServer) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		s.drop(conn)
+	}
+
+	return err
+}
+
+func (s *TCPBackplaneServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		send := make(chan []byte, tcpBackplaneQueueSize)
+
+		s.mu.Lock()
+		s.conns[conn] = send
+		s.mu.Unlock()
+
+		go s.write(conn, send)
+		go s.relay(conn)
+	}
+}
+
+// drop disconnects conn, s.mu must be held.
+func (s *TCPBackplaneServer) drop(conn net.Conn) {
+	if send, ok := s.conns[conn]; ok {
+		close(send)
+		delete(s.conns, conn)
+	}
+
+	conn.Close()
+}
+
+func (s *TCPBackplaneServer) write(conn net.Conn, send chan []byte) {
+	for data := range send {
+		conn.SetWriteDeadline(time.Now().Add(tcpBackplaneWriteWait))
+
+		if _, err := conn.Write(data); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (s *TCPBackplaneServer) relay(conn net.Conn) {
+	dec := json.NewDecoder(conn)
+
+	for {
+		var msg BackplaneMessage
+
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+
+		data, err := json.Marshal(&msg)
+
+		if err != nil {
+			continue
+		}
+
+		data = append(data, '\n')
+
+		s.mu.Lock()
+		for c, send := range s.conns {
+			select {
+			case send <- data:
+			default:
+				s.drop(c)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.drop(conn)
+	s.mu.Unlock()
+}
+
+// TCPBackplane is a Backplane client connected to a TCPBackplaneServer.
+type TCPBackplane struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	enc  *json.Encoder
+	mu   sync.RWMutex
+	subs map[int]func(*BackplaneMessage)
+	next int
+	done chan struct{}
+}
+
+// DialTCPBackplane connects to the TCPBackplaneServer listening on addr.
+func DialTCPBackplane(addr string) (*TCPBackplane, error) {
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := &TCPBackplane{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		subs: make(map[int]func(*BackplaneMessage)),
+		done: make(chan struct{}),
+	}
+
+	go b.readLoop()
+
+	return b, nil
+}
+
+// Publish sends msg to the relay server.
+func (b *TCPBackplane) Publish(msg *BackplaneMessage) error {
+	if b.closed() {
+		return ErrBackplaneClosed
+	}
+
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+
+	return b.enc.Encode(msg)
+}
+
+// Subscribe registers fn to be called for every message received from the relay server.
+func (b *TCPBackplane) Subscribe(fn func(*BackplaneMessage)) (func(), error) {
+	if b.closed() {
+		return nil, ErrBackplaneClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, id)
+	}, nil
+}
+
+// Close disconnects from the relay server.
+func (b *TCPBackplane) Close() error {
+	return b.conn.Close()
+}
+
+func (b *TCPBackplane) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *TCPBackplane) readLoop() {
+	defer close(b.done)
+
+	dec := json.NewDecoder(b.conn)
+
+	for {
+		var msg BackplaneMessage
+
+		if err := dec.Decode(&msg); err != nil {
+			b.conn.Close()
+			return
+		}
+
+		b.mu.RLock()
+		subs := make([]func(*BackplaneMessage), 0, len(b.subs))
+		for _, fn := range b.subs {
+			subs = append(subs, fn)
+		}
+		b.mu.RUnlock()
+
+		for _, fn := range subs {
+			fn(&msg)
+		}
+	}
+}
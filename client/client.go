@@ -0,0 +1,452 @@
+// Package client connects to melody servers. A Client reconnects with exponential
+// backoff when its connection drops, keeps messages written while disconnected
+// until they are sent, and resumes the session if the server has resumption
+// enabled, see melody.Config.ResumeWindow.
+//
+//	c := client.New("ws://localhost:5000/ws")
+//	c.HandleMessage(func(msg []byte) {
+//		fmt.Println(string(msg))
+//	})
+//	c.Write([]byte("hello"))
+//	c.Run(ctx)
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+var (
+	ErrClosed            = errors.New("client is closed")
+	ErrMessageBufferFull = errors.New("client message buffer is full")
+)
+
+// Config configures a Client.
+type Config struct {
+	WriteWait         time.Duration // Duration until write times out.
+	PongWait          time.Duration // Timeout for waiting on pong.
+	PingPeriod        time.Duration // Duration between pings.
+	MaxMessageSize    int64         // Maximum size in bytes of a message.
+	MessageBufferSize int           // The max amount of messages waiting to be sent, also while disconnected.
+	MinBackoff        time.Duration // Wait before the first reconnect, doubled for every failed attempt.
+	MaxBackoff        time.Duration // Maximum wait between reconnects.
+	MaxRetries        int           // Failed reconnects before Run gives up, 0 for no limit.
+	Resume            bool          // Resume the session on reconnect if the server has resumption enabled.
+}
+
+func newConfig() *Config {
+	return &Config{
+		WriteWait:         10 * time.Second,
+		PongWait:          60 * time.Second,
+		PingPeriod:        54 * time.Second,
+		MaxMessageSize:    512,
+		MessageBufferSize: 256,
+		MinBackoff:        500 * time.Millisecond,
+		MaxBackoff:        30 * time.Second,
+		Resume:            true,
+	}
+}
+
+type envelope struct {
+	t   int
+	msg []byte
+}
+
+// Client is a websocket client that stays connected to a melody server.
+type Client struct {
+	Config               *Config
+	Dialer               *websocket.Dialer
+	Header               http.Header // Sent with every connection attempt.
+	url                  string
+	messageHandler       func([]byte)
+	messageHandlerBinary func([]byte)
+	connectHandler       func()
+	resumeHandler        func()
+	disconnectHandler    func(error)
+	errorHandler         func(error)
+	mu                   sync.Mutex
+	queue                []envelope
+	queued               chan struct{}
+	conn                 *websocket.Conn
+	closed               bool
+	done                 chan struct{}
+	token                string // resume token of the session
+	seq                  uint64 // sequence number of the last message received
+}
+
+// New creates a client for the websocket server at url with the default Config and Dialer.
+func New(url string) *Client {
+	return &Client{
+		Config:               newConfig(),
+		Dialer:               websocket.DefaultDialer,
+		url:                  url,
+		messageHandler:       func([]byte) {},
+		messageHandlerBinary: func([]byte) {},
+		connectHandler:       func() {},
+		disconnectHandler:    func(error) {},
+		errorHandler:         func(error) {},
+		queued:               make(chan struct{}, 1),
+		done:                 make(chan struct{}),
+	}
+}
+
+// HandleConnect fires fn every time the client connects with a new session.
+func (c *Client) HandleConnect(fn func()) {
+	c.connectHandler = fn
+}
+
+// HandleResume fires fn instead of the connect handler when the client reconnected and
+// resumed its session. Messages sent while disconnected have been received before. If no
+// resume handler is set the connect handler fires.
+func (c *Client) HandleResume(fn func()) {
+	c.resumeHandler = fn
+}
+
+// HandleDisconnect fires fn with the reason when the connection drops.
+func (c *Client) HandleDisconnect(fn func(error)) {
+	c.disconnectHandler = fn
+}
+
+// HandleMessage fires fn when a text message comes in.
+func (c *Client) HandleMessage(fn func([]byte)) {
+	c.messageHandler = fn
+}
+
+// HandleMessageBinary fires fn when a binary message comes in.
+func (c *Client) HandleMessageBinary(fn func([]byte)) {
+	c.messageHandlerBinary = fn
+}
+
+// HandleError fires fn when a connection attempt or a read or write fails.
+func (c *Client) HandleError(fn func(error)) {
+	c.errorHandler = fn
+}
+
+// Write queues a text message to be sent to the server. Messages are kept while the
+// client is disconnected and sent in order once it has reconnected.
+func (c *Client) Write(msg []byte) error {
+	return c.enqueue(envelope{t: websocket.TextMessage, msg: msg})
+}
+
+// WriteBinary queues a binary message to be sent to the server, see Write.
+func (c *Client) WriteBinary(msg []byte) error {
+	return c.enqueue(envelope{t: websocket.BinaryMessage, msg: msg})
+}
+
+func (c *Client) enqueue(message envelope) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if len(c.queue) >= c.Config.MessageBufferSize {
+		return ErrMessageBufferFull
+	}
+
+	c.queue = append(c.queue, message)
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// dequeue takes the next message to send off the queue.
+func (c *Client) dequeue() (envelope, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.queue) == 0 {
+		return envelope{}, false
+	}
+
+	message := c.queue[0]
+	c.queue = c.queue[1:]
+
+	return message, true
+}
+
+// requeue puts a message that failed to send back at the front of the queue, unless the client is closed.
+func (c *Client) requeue(message envelope) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.queue = append([]envelope{message}, c.queue...)
+}
+
+// Close closes the connection with a normal closure and stops Run. Queued messages that
+// have not been sent are discarded.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	c.closed = true
+	c.queue = nil
+	close(c.done)
+
+	if c.conn != nil {
+		c.conn.WriteControl(websocket.CloseMessage, melody.FormatCloseMessage(melody.CloseNormalClosure, ""), time.Now().Add(c.Config.WriteWait))
+		c.conn.Close()
+	}
+
+	return nil
+}
+
+// IsClosed returns whether the client has been closed.
+func (c *Client) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+// Run connects to the server and keeps reconnecting until ctx is done, the client is
+// closed or Config.MaxRetries consecutive attempts have failed. It returns nil once the
+// client is closed, ctx.Err() once ctx is done and the last error otherwise.
+func (c *Client) Run(ctx context.Context) error {
+	for attempt := 0; ; {
+		conn, _, err := c.Dialer.DialContext(ctx, c.dialURL(), c.Header)
+
+		if err == nil {
+			attempt = 0
+			err = c.serve(ctx, conn)
+			c.disconnectHandler(err)
+		} else {
+			c.errorHandler(err)
+		}
+
+		if c.IsClosed() {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		attempt++
+
+		if c.Config.MaxRetries > 0 && attempt > c.Config.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(c.backoff(attempt))
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-c.done:
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// backoff returns the wait before attempt, doubling from Config.MinBackoff up to Config.MaxBackoff
+// with jitter so that clients dropped together do not reconnect together.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.Config.MinBackoff
+
+	for i := 1; i < attempt && wait < c.Config.MaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > c.Config.MaxBackoff {
+		wait = c.Config.MaxBackoff
+	}
+
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// dialURL returns the url to dial, asking to resume the last session if there is one.
+func (c *Client) dialURL() string {
+	c.mu.Lock()
+	token, seq := c.token, c.seq
+	c.mu.Unlock()
+
+	if !c.Config.Resume || token == "" {
+		return c.url
+	}
+
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return c.url
+	}
+
+	query := u.Query()
+	query.Set("resume", token)
+	query.Set("seq", strconv.FormatUint(seq, 10))
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// serve runs conn until it drops or ctx is done.
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	resuming := c.Config.Resume && c.token != ""
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		c.writePump(ctx, conn, stop)
+		close(stopped)
+	}()
+
+	if !resuming {
+		c.connectHandler()
+	}
+
+	err := c.readPump(conn, resuming)
+
+	close(stop)
+	conn.Close()
+	<-stopped
+
+	return err
+}
+
+func (c *Client) readPump(conn *websocket.Conn, resuming bool) error {
+	conn.SetReadLimit(c.Config.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(c.Config.PongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(c.Config.PongWait))
+		return nil
+	})
+
+	first := true
+
+	for {
+		t, message, err := conn.ReadMessage()
+
+		if err != nil {
+			return err
+		}
+
+		if first {
+			first = false
+
+			if c.Config.Resume && t == websocket.TextMessage && c.greeted(message, resuming) {
+				continue
+			}
+
+			if resuming {
+				c.connectHandler()
+			}
+		}
+
+		c.mu.Lock()
+		c.seq++
+		c.mu.Unlock()
+
+		switch t {
+		case websocket.TextMessage:
+			c.messageHandler(message)
+		case websocket.BinaryMessage:
+			c.messageHandlerBinary(message)
+		}
+	}
+}
+
+// greeted handles the melody.ResumeEvent the server starts resumable sessions with and fires the
+// resume or connect handler when resuming. It returns false if msg is not the event.
+func (c *Client) greeted(msg []byte, resuming bool) bool {
+	var event struct {
+		Type string            `json:"type"`
+		Data melody.ResumeInfo `json:"data"`
+	}
+
+	if err := json.Unmarshal(msg, &event); err != nil || event.Type != melody.ResumeEvent || event.Data.Token == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	resumed := c.token == event.Data.Token
+	c.token, c.seq = event.Data.Token, event.Data.Seq
+	c.mu.Unlock()
+
+	switch {
+	case resuming && resumed && c.resumeHandler != nil:
+		c.resumeHandler()
+	case resuming:
+		c.connectHandler()
+	}
+
+	return true
+}
+
+func (c *Client) writePump(ctx context.Context, conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(c.Config.PingPeriod)
+	defer ticker.Stop()
+
+	for {
+		next, pending := c.dequeue()
+
+		if pending {
+			conn.SetWriteDeadline(time.Now().Add(c.Config.WriteWait))
+
+			if err := conn.WriteMessage(next.t, next.msg); err != nil {
+				c.requeue(next)
+				c.errorHandler(err)
+				conn.Close()
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case <-c.queued:
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.Config.WriteWait)); err != nil {
+				c.errorHandler(err)
+				conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, melody.FormatCloseMessage(melody.CloseGoingAway, ""), time.Now().Add(c.Config.WriteWait))
+			conn.Close()
+			return
+		case <-stop:
+			return
+		}
+	}
+}
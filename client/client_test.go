@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(m *melody.Melody) (*httptest.Server, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleRequest(w, r)
+	}))
+
+	return server, strings.Replace(server.URL, "http", "ws", 1)
+}
+
+func TestClient(t *testing.T) {
+	sessions := make(chan *melody.Session, 2)
+
+	m := melody.New()
+	m.HandleConnect(func(s *melody.Session) {
+		sessions <- s
+	})
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		s.Write(msg)
+	})
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
+		s.WriteBinary(msg)
+	})
+
+	server, url := newServer(m)
+	defer server.Close()
+
+	connected := make(chan struct{}, 2)
+	disconnected := make(chan error, 2)
+	messages := make(chan string, 4)
+
+	c := New(url)
+	c.Config.MinBackoff = 10 * time.Millisecond
+	c.HandleConnect(func() {
+		connected <- struct{}{}
+	})
+	c.HandleDisconnect(func(err error) {
+		disconnected <- err
+	})
+	c.HandleMessage(func(msg []byte) {
+		messages <- string(msg)
+	})
+	c.HandleMessageBinary(func(msg []byte) {
+		messages <- "binary " + string(msg)
+	})
+
+	assert.Nil(t, c.Write([]byte("queued")))
+
+	done := make(chan error)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+
+	<-connected
+	assert.Equal(t, "queued", <-messages)
+
+	assert.Nil(t, c.WriteBinary([]byte("bin")))
+	assert.Equal(t, "binary bin", <-messages)
+
+	s := <-sessions
+	s.Close()
+	<-disconnected
+
+	assert.Nil(t, c.Write([]byte("while disconnected")))
+
+	<-connected
+	assert.Equal(t, "while disconnected", <-messages)
+	assert.NotEqual(t, s, <-sessions)
+
+	assert.Nil(t, c.Close())
+	assert.Nil(t, <-done)
+	assert.Equal(t, ErrClosed, c.Write(nil))
+}
+
+func TestClientResume(t *testing.T) {
+	sessions := make(chan *melody.Session, 1)
+	disconnected := make(chan struct{}, 1)
+
+	m := melody.New()
+	m.Config.ResumeWindow = time.Minute
+	m.HandleConnect(func(s *melody.Session) {
+		sessions <- s
+	})
+	m.HandleDisconnect(func(s *melody.Session) {
+		disconnected <- struct{}{}
+	})
+
+	server, url := newServer(m)
+	defer server.Close()
+
+	connects := make(chan struct{}, 2)
+	resumes := make(chan struct{}, 1)
+	messages := make(chan string, 4)
+
+	c := New(url)
+	c.Config.MinBackoff = 50 * time.Millisecond
+	c.HandleConnect(func() {
+		connects <- struct{}{}
+	})
+	c.HandleResume(func() {
+		resumes <- struct{}{}
+	})
+	c.HandleMessage(func(msg []byte) {
+		messages <- string(msg)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go c.Run(ctx)
+
+	<-connects
+	s := <-sessions
+
+	m.Broadcast([]byte("one"))
+	assert.Equal(t, "one", <-messages)
+
+	s.Close()
+	<-disconnected
+
+	m.Broadcast([]byte("two"))
+
+	<-resumes
+	assert.Equal(t, "two", <-messages)
+	assert.Len(t, connects, 0)
+
+	m.Broadcast([]byte("three"))
+	assert.Equal(t, "three", <-messages)
+}
+
+func TestClientMaxRetries(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	server.Close()
+
+	errs := 0
+
+	c := New(url)
+	c.Config.MinBackoff = time.Millisecond
+	c.Config.MaxRetries = 2
+	c.HandleError(func(error) {
+		errs++
+	})
+
+	assert.NotNil(t, c.Run(context.Background()))
+	assert.Equal(t, 3, errs)
+}
+
+func TestBackoff(t *testing.T) {
+	c := New("ws://localhost")
+	c.Config.MinBackoff = time.Second
+	c.Config.MaxBackoff = 5 * time.Second
+
+	for attempt, max := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if attempt == 0 {
+			continue
+		}
+		wait := c.backoff(attempt)
+		assert.GreaterOrEqual(t, wait, max/2)
+		assert.LessOrEqual(t, wait, max)
+	}
+}
+
+// slowConn blocks the first write once slow is set until release is closed.
+type slowConn struct {
+	net.Conn
+	slow    atomic.Bool
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	if c.slow.CompareAndSwap(true, false) {
+		close(c.writing)
+		<-c.release
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestClientCloseDuringWrite(t *testing.T) {
+	connected := make(chan struct{}, 1)
+
+	m := melody.New()
+	server, url := newServer(m)
+	defer server.Close()
+
+	conn := &slowConn{writing: make(chan struct{}), release: make(chan struct{})}
+
+	c := New(url)
+	c.Dialer = &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			var err error
+			conn.Conn, err = net.Dial(network, addr)
+			return conn, err
+		},
+	}
+	c.HandleConnect(func() {
+		connected <- struct{}{}
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+
+	<-connected
+
+	conn.slow.Store(true)
+	assert.Nil(t, c.Write([]byte("slow")))
+	<-conn.writing
+
+	closed := make(chan error)
+	go func() {
+		closed <- c.Close()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(conn.release)
+
+	assert.Nil(t, <-closed)
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,69 @@
+package melody
+
+import "time"
+
+// Clock tells the time and creates the timers of melody. Set Config.Clock to control
+// time in tests, see the melodytest package.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock, see time.Timer.
+type Timer interface {
+	C() <-chan time.Time // nil for timers created with AfterFunc.
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a ticker created by a Clock, see time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+func (m *Melody) now() time.Time {
+	return m.Config.Clock.Now()
+}
+
+func (m *Melody) sleep(d time.Duration) {
+	timer := m.Config.Clock.NewTimer(d)
+	<-timer.C()
+}
@@ -0,0 +1,225 @@
+package melody_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+	"github.com/olahol/melody/melodytest"
+	"github.com/stretchr/testify/assert"
+)
+
+// advanceUntil advances clock by d until ch receives, the pumps of a session
+// start their timers after it connects.
+func advanceUntil[T any](clock *melodytest.Clock, d time.Duration, ch <-chan T) {
+	for {
+		clock.Advance(d)
+
+		select {
+		case <-ch:
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	clock := melodytest.NewClock()
+	pongs := make(chan *melody.Session, 1)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.HandlePong(func(s *melody.Session) {
+		select {
+		case pongs <- s:
+		default:
+		}
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleRequest(w, r)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	go conn.NextReader()
+
+	advanceUntil(clock, m.Config.PingPeriod, pongs)
+}
+
+func TestPongTimeout(t *testing.T) {
+	clock := melodytest.NewClock()
+
+	m := melody.New()
+	m.Config.Clock = clock
+
+	c := melodytest.Dial(m)
+	c.Session()
+	c.IgnorePings(true)
+
+	advanceUntil(clock, m.Config.PingPeriod, c.Done())
+	assert.Nil(t, c.Err())
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestRequestTimeoutClock(t *testing.T) {
+	clock := melodytest.NewClock()
+
+	m := melody.New()
+	m.Config.Clock = clock
+
+	c := melodytest.Dial(m)
+	s := c.Session()
+
+	errs := make(chan error)
+	go func() {
+		_, err := s.SendRequest(context.Background(), []byte(`{}`))
+		errs <- err
+	}()
+
+	_, _, err := c.Receive()
+	assert.Nil(t, err)
+
+	clock.Advance(m.Config.RequestTimeout)
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+}
+
+func TestResumeWindowClock(t *testing.T) {
+	clock := melodytest.NewClock()
+	connects := make(chan struct{}, 3)
+	resumes := make(chan struct{}, 3)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.Config.ResumeWindow = time.Minute
+	m.HandleConnect(func(s *melody.Session) {
+		connects <- struct{}{}
+	})
+	m.HandleResume(func(s *melody.Session) {
+		resumes <- struct{}{}
+	})
+
+	// dial connects a client that drops once it has read the resume event and
+	// reports whether it resumed a session, returning its resume token.
+	dial := func(token string) (string, bool) {
+		d := &melodytest.Dialer{}
+		if token != "" {
+			d.Request = httptest.NewRequest(http.MethodGet, "/?seq=0&resume="+token, nil)
+		}
+
+		c := d.Dial(m)
+
+		_, msg, err := c.Receive()
+		assert.Nil(t, err)
+
+		var event struct {
+			Data melody.ResumeInfo
+		}
+		assert.Nil(t, json.Unmarshal(msg, &event))
+
+		c.Drop()
+		c.ExpectDisconnect(t)
+
+		select {
+		case <-resumes:
+			return event.Data.Token, true
+		case <-connects:
+			return event.Data.Token, false
+		}
+	}
+
+	token, resumed := dial("")
+	assert.False(t, resumed)
+
+	clock.Advance(m.Config.ResumeWindow - time.Second)
+
+	token, resumed = dial(token)
+	assert.True(t, resumed)
+
+	clock.Advance(m.Config.ResumeWindow)
+
+	_, resumed = dial(token)
+	assert.False(t, resumed)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := melodytest.NewClock()
+	errs := make(chan error, 1)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.Config.IdleTimeout = time.Minute
+	m.Config.PingPeriod = 24 * time.Hour
+	m.Config.PongWait = 25 * time.Hour
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		s.Write(msg)
+	})
+	m.HandleError(func(s *melody.Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	reasons := make(chan melody.CloseReason, 1)
+	m.HandleDisconnectWithReason(func(s *melody.Session, reason melody.CloseReason) {
+		reasons <- reason
+	})
+
+	c := melodytest.Dial(m)
+	c.Session()
+
+	clock.Advance(m.Config.IdleTimeout / 2)
+	assert.Nil(t, c.Send([]byte("ping")))
+	c.Expect(t, []byte("ping"))
+
+	clock.Advance(m.Config.IdleTimeout / 2)
+	c.ExpectNothing(t, 10*time.Millisecond)
+
+	advanceUntil(clock, m.Config.IdleTimeout/2, c.Done())
+	c.ExpectClose(t, melody.CloseGoingAway)
+	assert.ErrorIs(t, <-errs, melody.ErrIdleTimeout)
+
+	reason := <-reasons
+	assert.Equal(t, melody.InitiatorServer, reason.Initiator)
+	assert.Equal(t, melody.CloseGoingAway, reason.Code)
+	assert.ErrorIs(t, reason.Err, melody.ErrIdleTimeout)
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	clock := melodytest.NewClock()
+	errs := make(chan error, 1)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.Config.MaxSessionLifetime = time.Hour
+	m.Config.PingPeriod = 24 * time.Hour
+	m.Config.PongWait = 25 * time.Hour
+	m.Config.LifetimeJitter = 10 * time.Minute
+	m.Config.LifetimeCloseCode = melody.CloseTryAgainLater
+	m.HandleError(func(s *melody.Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	c := melodytest.Dial(m)
+	c.Session()
+
+	clock.Advance(m.Config.MaxSessionLifetime - time.Second)
+	c.ExpectNothing(t, 10*time.Millisecond)
+
+	advanceUntil(clock, m.Config.LifetimeJitter/10, c.Done())
+	c.ExpectClose(t, melody.CloseTryAgainLater)
+	assert.ErrorIs(t, <-errs, melody.ErrLifetimeExceeded)
+}
@@ -0,0 +1,122 @@
+package melody
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultCompressionLevel is the compression level gorilla/websocket uses by default.
+const defaultCompressionLevel = 1
+
+// upgrader returns the upgrader to use, with compression enabled if Config.EnableCompression is set.
+func (m *Melody) upgrader() *websocket.Upgrader {
+	if !m.Config.EnableCompression || m.Upgrader.EnableCompression {
+		return m.Upgrader
+	}
+
+	upgrader := *m.Upgrader
+	upgrader.EnableCompression = true
+
+	return &upgrader
+}
+
+// negotiatesCompression reports whether upgrader will negotiate permessage-deflate with r.
+func negotiatesCompression(upgrader *websocket.Upgrader, r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+
+	for _, ext := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Melody) compressionLevel() int {
+	if m.Config.CompressionLevel == 0 {
+		return defaultCompressionLevel
+	}
+	return m.Config.CompressionLevel
+}
+
+// shouldCompress reports whether message should be compressed.
+func (s *Session) shouldCompress(message envelope) bool {
+	if message.compress != nil {
+		return *message.compress
+	}
+	return len(message.msg) >= s.melody.Config.CompressionThreshold
+}
+
+// measuresCompression reports whether the compressed size of messages is reported to the metrics.
+func (m *Melody) measuresCompression() bool {
+	_, nop := m.Config.Metrics.(nopMetrics)
+	return !nop
+}
+
+// countingWriter hands out the hijacked connection wrapped in a countingConn, so that the
+// size of compressed messages can be measured as they are written.
+type countingWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &countingConn{Conn: conn}
+
+	return w.conn, brw, nil
+}
+
+// countingConn counts the bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// BroadcastCompressed broadcasts a text message to all sessions, compressing
+// it if compress is set regardless of Config.CompressionThreshold.
+func (m *Melody) BroadcastCompressed(msg []byte, compress bool) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	message := envelope{t: websocket.TextMessage, msg: msg, compress: &compress}
+
+	return m.broadcast(message, "")
+}
+
+// BroadcastBinaryCompressed broadcasts a binary message to all sessions, compressing
+// it if compress is set regardless of Config.CompressionThreshold.
+func (m *Melody) BroadcastBinaryCompressed(msg []byte, compress bool) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	message := envelope{t: websocket.BinaryMessage, msg: msg, compress: &compress}
+
+	return m.broadcast(message, "")
+}
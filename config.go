@@ -1,23 +1,76 @@
 package melody
 
-import "time"
+import (
+	"net/http"
+	"time"
+)
 
 // Config melody configuration struct.
 type Config struct {
-	WriteWait                 time.Duration // Duration until write times out.
-	PongWait                  time.Duration // Timeout for waiting on pong.
-	PingPeriod                time.Duration // Duration between pings.
-	MaxMessageSize            int64         // Maximum size in bytes of a message.
-	MessageBufferSize         int           // The max amount of messages that can be in a sessions buffer before it starts dropping them.
-	ConcurrentMessageHandling bool          // Handle messages from sessions concurrently.
+	WriteWait                 time.Duration              // Duration until write times out.
+	PongWait                  time.Duration              // Timeout for waiting on pong.
+	PingPeriod                time.Duration              // Duration between pings.
+	MaxMessageSize            int64                      // Maximum size in bytes of a message.
+	MessageBufferSize         int                        // The max amount of messages that can be in a sessions buffer before it starts dropping them.
+	ConcurrentMessageHandling bool                       // Handle messages from sessions concurrently.
+	SessionIDGenerator        func(*http.Request) string // Generates unique session IDs, defaults to random hex strings.
+	RequestTimeout            time.Duration              // Timeout for Session.SendRequest when the context has no deadline.
+	OverflowPolicy            OverflowPolicy             // What to do with messages written to a session with a full buffer.
+	OverflowTimeout           time.Duration              // How long OverflowBlock waits for room in a full buffer.
+	ShutdownCloseCode         int                        // Close code sent to sessions by Melody.Shutdown.
+	Metrics                   Metrics                    // Receives measurements, see NewMetricsCollector.
+	SessionRateLimit          RateLimit                  // Limits inbound messages per session.
+	IPRateLimit               RateLimit                  // Limits inbound messages per remote IP, shared by all sessions from that IP.
+	RateLimitAction           RateLimitAction            // What to do with messages that exceed a rate limit.
+	RateLimitWarning          []byte                     // Message written to the session by RateLimitWarn.
+	CloseOnPanic              bool                       // Close sessions with CloseInternalServerErr when a handler panics.
+	WorkerPoolSize            int                        // Handle messages on this many workers shared by all sessions, overrides ConcurrentMessageHandling.
+	WorkerQueueSize           int                        // Messages waiting for a free worker before the pool is saturated.
+	MaxInFlight               int                        // Maximum messages of a session queued or being handled by the pool, 0 for no limit or WorkerQueueSize with PreserveMessageOrder.
+	PreserveMessageOrder      bool                       // Handle messages of a session in order when using the worker pool.
+	ShedWhenSaturated         bool                       // Drop messages instead of waiting when the pool or MaxInFlight is saturated.
+	AuthTimeout               time.Duration              // Time a session has to authenticate with its first message, see MessageAuthenticator.
+	CredentialRefreshWindow   time.Duration              // How long before credentials expire HandleCredentialExpiring fires.
+	CredentialCloseCode       int                        // Close code sent to sessions whose credentials have expired.
+	EnableCompression         bool                       // Negotiate permessage-deflate compression with clients that support it.
+	CompressionLevel          int                        // Compression level, see compress/flate, 0 for the default level.
+	CompressionThreshold      int                        // Messages smaller than this many bytes are written uncompressed.
+	ResumeWindow              time.Duration              // How long a disconnected session can be resumed, 0 disables resumption, see ResumeInfo.
+	ResumeBufferSize          int                        // The max amount of sent messages kept per session for replay on resumption.
+	PresenceKey               string                     // Key in Session.Keys holding the user of a session for presence tracking, "" disables presence.
+	PresenceDebounce          time.Duration              // How long a user stays present after its last session left, so quick reconnects don't flap.
+	PresenceBroadcast         bool                       // Write presence events to the members of their room on this instance as the "presence" event.
+	PollTimeout               time.Duration              // How long a poll of TransportPoll waits for messages before it is answered empty.
+	Clock                     Clock                      // Tells the time for all timers and deadlines, defaults to the time package.
+	IdleTimeout               time.Duration              // Close sessions that have not sent or received a message for this long, 0 disables.
+	IdleCloseCode             int                        // Close code sent to sessions closed by IdleTimeout.
+	MaxSessionLifetime        time.Duration              // Close sessions after they have been connected this long so that clients reconnect, 0 disables.
+	LifetimeJitter            time.Duration              // Random extra lifetime up to this long per session, so sessions that connected together don't close together.
+	LifetimeCloseCode         int                        // Close code sent to sessions closed by MaxSessionLifetime.
 }
 
 func newConfig() *Config {
 	return &Config{
-		WriteWait:         10 * time.Second,
-		PongWait:          60 * time.Second,
-		PingPeriod:        54 * time.Second,
-		MaxMessageSize:    512,
-		MessageBufferSize: 256,
+		WriteWait:               10 * time.Second,
+		PongWait:                60 * time.Second,
+		PingPeriod:              54 * time.Second,
+		MaxMessageSize:          512,
+		MessageBufferSize:       256,
+		RequestTimeout:          10 * time.Second,
+		OverflowTimeout:         time.Second,
+		ShutdownCloseCode:       CloseServiceRestart,
+		Metrics:                 nopMetrics{},
+		WorkerQueueSize:         1024,
+		AuthTimeout:             10 * time.Second,
+		CredentialRefreshWindow: time.Minute,
+		CredentialCloseCode:     ClosePolicyViolation,
+		ResumeBufferSize:        256,
+		PollTimeout:             25 * time.Second,
+		Clock:                   realClock{},
+		IdleCloseCode:           CloseGoingAway,
+		LifetimeCloseCode:       CloseServiceRestart,
+		SessionIDGenerator: func(*http.Request) string {
+			return randomID()
+		},
 	}
 }
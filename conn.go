@@ -0,0 +1,92 @@
+package melody
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the connection of a session. *websocket.Conn from gorilla/websocket, used by
+// HandleRequest, is the default implementation. Implement it to serve sessions over another
+// websocket library or an in-memory pipe with HandleConn. The methods follow the semantics
+// of their *websocket.Conn counterparts, message types are TextMessage, BinaryMessage,
+// CloseMessage, PingMessage and PongMessage.
+//
+// Melody calls the methods from these goroutines, an implementation must lock accordingly:
+//   - ReadMessage, SetReadLimit, SetReadDeadline and the handler setters from one reader.
+//     The pong handler calls SetReadDeadline too, from wherever the implementation runs it:
+//     ReadMessage calls it on the reader, an implementation that runs it elsewhere must
+//     make SetReadDeadline safe to call concurrently with ReadMessage.
+//   - WriteMessage and SetWriteDeadline from one writer, other than the reader.
+//   - WriteControl, Close and the address methods from any goroutine, concurrently with
+//     all other methods.
+type Conn interface {
+	// ReadMessage reads the next data message. Pong and close messages are passed to the
+	// handlers set with SetPongHandler and SetCloseHandler while reading.
+	ReadMessage() (messageType int, data []byte, err error)
+	// WriteMessage writes a data, close or ping message.
+	WriteMessage(messageType int, data []byte) error
+	// WriteControl writes a close, ping or pong message before deadline.
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	// SetReadLimit sets the maximum size in bytes of a read message.
+	SetReadLimit(limit int64)
+	// SetReadDeadline sets when ReadMessage fails if no message has been read.
+	SetReadDeadline(t time.Time) error
+	// SetWriteDeadline sets when WriteMessage fails if the message has not been written.
+	SetWriteDeadline(t time.Time) error
+	// SetPongHandler sets the handler for pong messages.
+	SetPongHandler(h func(appData string) error)
+	// SetCloseHandler sets the handler for close messages.
+	SetCloseHandler(h func(code int, text string) error)
+	// Close closes the connection without sending a close message.
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// compressionWriter is implemented by connections that can toggle compression per message.
+type compressionWriter interface {
+	EnableWriteCompression(enable bool)
+}
+
+// preparedWriter is implemented by connections that write prepared messages, see envelope.prepared.
+type preparedWriter interface {
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+}
+
+var _ Conn = (*websocket.Conn)(nil)
+
+// HandleConn serves a session over conn, a connection established without HandleRequest such as
+// one from another websocket library or an in-memory pipe. r is the request conn was opened with,
+// it becomes Session.Request and may be nil. It is authenticated with the Authenticator, a rejected
+// request closes conn with ClosePolicyViolation. Like HandleRequest it returns once the session
+// has disconnected.
+func (m *Melody) HandleConn(conn Conn, r *http.Request, keys map[string]any) error {
+	if m.hub.closed() {
+		conn.Close()
+		return ErrClosed
+	}
+
+	if r == nil {
+		r = &http.Request{Method: http.MethodGet, URL: &url.URL{}, Header: make(http.Header)}
+		if addr := conn.RemoteAddr(); addr != nil {
+			r.RemoteAddr = addr.String()
+		}
+	}
+
+	var principal any
+
+	if m.Authenticator != nil {
+		var err error
+		if principal, err = m.Authenticator.Authenticate(r); err != nil {
+			conn.WriteControl(websocket.CloseMessage, FormatCloseMessage(ClosePolicyViolation, "authentication failed"), m.now().Add(m.Config.WriteWait))
+			conn.Close()
+			return err
+		}
+	}
+
+	return m.serve(m.newSession(r, keys, conn, principal))
+}
@@ -0,0 +1,107 @@
+package melody
+
+import "time"
+
+// credentials tracks when the credentials of a session expire, guarded by Session.rwmutex.
+type credentials struct {
+	expiry  time.Time
+	warned  bool
+	changed chan struct{}
+}
+
+// SetCredentialExpiry sets when the credentials of the session expire. Config.CredentialRefreshWindow
+// before that HandleCredentialExpiring fires, and at expiry the session is closed with
+// Config.CredentialCloseCode. A zero time removes the expiry.
+func (s *Session) SetCredentialExpiry(expiry time.Time) {
+	s.rwmutex.Lock()
+	s.creds.expiry = expiry
+	s.creds.warned = false
+	s.rwmutex.Unlock()
+
+	select {
+	case s.creds.changed <- struct{}{}:
+	default:
+	}
+}
+
+// CredentialExpiry returns when the credentials of the session expire, or the zero time.
+func (s *Session) CredentialExpiry() time.Time {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.creds.expiry
+}
+
+// Reauthenticate replaces the principal of the session and the expiry of its credentials,
+// typically after the client has presented refreshed credentials.
+func (s *Session) Reauthenticate(principal any, expiry time.Time) {
+	s.rwmutex.Lock()
+	s.principal = principal
+	s.rwmutex.Unlock()
+
+	s.SetCredentialExpiry(expiry)
+}
+
+// credentialWait returns how long until the credentials need to be checked and whether they expire at all.
+func (s *Session) credentialWait() (time.Duration, bool) {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	if s.creds.expiry.IsZero() {
+		return 0, false
+	}
+
+	at := s.creds.expiry
+
+	if window := s.melody.Config.CredentialRefreshWindow; window > 0 && !s.creds.warned {
+		at = at.Add(-window)
+	}
+
+	wait := at.Sub(s.melody.now())
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, true
+}
+
+// checkCredentials fires the expiring handler when the refresh window is reached and
+// reports whether the credentials have expired.
+func (s *Session) checkCredentials() bool {
+	s.rwmutex.Lock()
+
+	expiry := s.creds.expiry
+
+	if expiry.IsZero() {
+		s.rwmutex.Unlock()
+		return false
+	}
+
+	now := s.melody.now()
+
+	if !now.Before(expiry) {
+		s.rwmutex.Unlock()
+		return true
+	}
+
+	window := s.melody.Config.CredentialRefreshWindow
+	warn := window > 0 && !s.creds.warned && !now.Before(expiry.Add(-window))
+
+	if warn {
+		s.creds.warned = true
+	}
+
+	s.rwmutex.Unlock()
+
+	if warn {
+		go s.credentialExpiring(expiry)
+	}
+
+	return false
+}
+
+func (s *Session) credentialExpiring(expiry time.Time) {
+	defer s.recoverPanic()
+
+	s.melody.expiringHandler(s, expiry)
+}
@@ -1,7 +1,10 @@
 package melody
 
 type envelope struct {
-	t      int
-	msg    []byte
-	filter filterFunc
+	t        int
+	msg      []byte
+	filter   filterFunc
+	key      string
+	compress *bool
+	prepared *prepared
 }
@@ -7,4 +7,17 @@ var (
 	ErrSessionClosed     = errors.New("session is closed")
 	ErrWriteClosed       = errors.New("tried to write to closed a session")
 	ErrMessageBufferFull = errors.New("session message buffer is full")
+	ErrBackplaneClosed   = errors.New("backplane is closed")
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrInvalidEvent      = errors.New("invalid event payload")
+	ErrInvalidPayload    = errors.New("payload is not valid JSON")
+	ErrWorkerPoolFull    = errors.New("worker pool is saturated")
+	ErrUnauthenticated   = errors.New("session is not authenticated")
+	ErrCredentialExpired = errors.New("session credentials have expired")
+	ErrNotTracked        = errors.New("session is not tracked by presence")
+	ErrUnknownTransport  = errors.New("unknown or unsupported transport")
+	ErrIdleTimeout       = errors.New("session has been idle for too long")
+	ErrLifetimeExceeded  = errors.New("session has reached its maximum lifetime")
+	ErrRateLimited       = errors.New("session has exceeded its rate limit")
+	ErrSessionResumed    = errors.New("session was resumed by another connection")
 )
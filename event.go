@@ -0,0 +1,113 @@
+package melody
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// frame is the JSON wire format shared by events and requests. Events carry
+// a type, requests an id and replies the id of the request they answer.
+type frame struct {
+	Type    string          `json:"type,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type eventHandlerFunc func(*Session, json.RawMessage) error
+
+// EventError is reported to the error handler when an event handler
+// registered with On fails or its payload cannot be decoded.
+type EventError struct {
+	Event string
+	Err   error
+}
+
+func (e *EventError) Error() string {
+	return fmt.Sprintf("melody: event %q: %v", e.Event, e.Err)
+}
+
+func (e *EventError) Unwrap() error {
+	return e.Err
+}
+
+// On registers fn to handle text messages of the form {"type": event, "data": ...}.
+// The data field is decoded as JSON into a T before fn is called. Decode failures
+// and errors returned by fn are reported to HandleError as an *EventError.
+// Text messages that are not events, or events without a registered handler,
+// are passed on to HandleMessage.
+func On[T any](m *Melody, event string, fn func(*Session, T) error) {
+	m.events[event] = func(s *Session, data json.RawMessage) error {
+		var payload T
+
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &payload); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+			}
+		}
+
+		return fn(s, payload)
+	}
+}
+
+// dispatchFrame calls the event or call handler registered for msg and reports whether there was one.
+func (m *Melody) dispatchFrame(s *Session, msg []byte) bool {
+	if len(m.events) == 0 && m.callHandler == nil {
+		return false
+	}
+
+	var f frame
+
+	if err := json.Unmarshal(msg, &f); err != nil {
+		return false
+	}
+
+	if f.Type == "" && f.ID != "" && m.callHandler != nil {
+		m.callHandler(s, &Call{ID: f.ID, Data: f.Data, session: s})
+		return true
+	}
+
+	fn, ok := m.events[f.Type]
+
+	if !ok {
+		return false
+	}
+
+	if err := fn(s, f.Data); err != nil {
+		m.errorHandler(s, &EventError{Event: f.Type, Err: err})
+	}
+
+	return true
+}
+
+func encodeEvent(event string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(frame{Type: event, Data: data})
+}
+
+// Emit writes v to the session as the event {"type": event, "data": v}.
+func (s *Session) Emit(event string, v any) error {
+	msg, err := encodeEvent(event, v)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Write(msg)
+}
+
+// BroadcastEvent broadcasts v to all sessions as the event {"type": event, "data": v}.
+func (m *Melody) BroadcastEvent(event string, v any) error {
+	msg, err := encodeEvent(event, v)
+
+	if err != nil {
+		return err
+	}
+
+	return m.Broadcast(msg)
+}
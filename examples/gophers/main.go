@@ -3,13 +3,10 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"sync/atomic"
 
 	"github.com/olahol/melody"
 )
 
-var idCounter atomic.Int64
-
 func main() {
 	m := melody.New()
 
@@ -22,23 +19,15 @@ func main() {
 	})
 
 	m.HandleConnect(func(s *melody.Session) {
-		id := idCounter.Add(1)
-
-		s.Set("id", id)
-
-		s.Write([]byte(fmt.Sprintf("iam %d", id)))
+		s.Write([]byte(fmt.Sprintf("iam %s", s.ID())))
 	})
 
 	m.HandleDisconnect(func(s *melody.Session) {
-		if id, ok := s.Get("id"); ok {
-			m.BroadcastOthers([]byte(fmt.Sprintf("dis %d", id)), s)
-		}
+		m.BroadcastOthers([]byte(fmt.Sprintf("dis %s", s.ID())), s)
 	})
 
 	m.HandleMessage(func(s *melody.Session, msg []byte) {
-		if id, ok := s.Get("id"); ok {
-			m.BroadcastOthers([]byte(fmt.Sprintf("set %d %s", id, msg)), s)
-		}
+		m.BroadcastOthers([]byte(fmt.Sprintf("set %s %s", s.ID(), msg)), s)
 	})
 
 	http.ListenAndServe(":5000", nil)
@@ -21,10 +21,12 @@ func main() {
 		m.HandleRequest(w, r)
 	})
 
+	m.HandleConnect(func(s *melody.Session) {
+		s.Join(s.Request.PathValue("chan"))
+	})
+
 	m.HandleMessage(func(s *melody.Session, msg []byte) {
-		m.BroadcastFilter(msg, func(q *melody.Session) bool {
-			return q.Request.URL.Path == s.Request.URL.Path
-		})
+		m.BroadcastRoom(s.Request.PathValue("chan"), msg)
 	})
 
 	http.ListenAndServe(":5000", nil)
@@ -8,12 +8,21 @@ import (
 type hub struct {
 	mu       sync.RWMutex
 	sessions map[*Session]struct{}
+	ids      map[string]*Session
+	rooms    map[string]map[*Session]struct{} // members of each room, parked sessions included
+	parked   map[string]*Session              // disconnected sessions that can be resumed, by resume token
+	tokens   map[string]*Session              // connected sessions that can be resumed, by resume token
 	open     atomic.Bool
+	active   sync.WaitGroup // registered sessions whose request has not returned
 }
 
 func newHub() *hub {
 	hub := &hub{
 		sessions: make(map[*Session]struct{}),
+		ids:      make(map[string]*Session),
+		rooms:    make(map[string]map[*Session]struct{}),
+		parked:   make(map[string]*Session),
+		tokens:   make(map[string]*Session),
 	}
 	hub.open.Store(true)
 	return hub
@@ -41,11 +50,23 @@ func (h *hub) all() []*Session {
 	return result
 }
 
-func (h *hub) register(s *Session) {
+func (h *hub) register(s *Session) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if h.closed() {
+		return false
+	}
+
 	h.sessions[s] = struct{}{}
+	h.ids[s.id] = s
+	h.active.Add(1)
+
+	if s.resume != nil {
+		h.tokens[s.resume.token] = s
+	}
+
+	return true
 }
 
 func (h *hub) unregister(s *Session) {
@@ -53,27 +74,281 @@ func (h *hub) unregister(s *Session) {
 	defer h.mu.Unlock()
 
 	delete(h.sessions, s)
+	if h.ids[s.id] == s {
+		delete(h.ids, s.id)
+	}
+	if s.resume != nil && h.tokens[s.resume.token] == s {
+		delete(h.tokens, s.resume.token)
+	}
+
+	for room := range s.rooms {
+		h.leave(s, room)
+	}
+}
+
+// park moves s out of the hub while keeping it in its rooms, broadcasts to them are recorded for replay.
+func (h *hub) park(s *Session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed() {
+		return false
+	}
+
+	delete(h.sessions, s)
+	if h.ids[s.id] == s {
+		delete(h.ids, s.id)
+	}
+	if h.tokens[s.resume.token] == s {
+		delete(h.tokens, s.resume.token)
+	}
+
+	s.parked = true
+	h.parked[s.resume.token] = s
+
+	return true
+}
+
+// expire removes s if it is still parked.
+func (h *hub) expire(s *Session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.parked[s.resume.token] != s {
+		return false
+	}
+
+	delete(h.parked, s.resume.token)
+
+	for room := range s.rooms {
+		h.leave(s, room)
+	}
+
+	return true
+}
+
+// connected returns the connected session that can be resumed with token.
+func (h *hub) connected(token string) (*Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.tokens[token]
+	return s, ok
+}
+
+// resume registers s in place of the session parked with token, taking over its id, keys, rooms
+// and history, and returns the messages after seq.
+func (h *hub) resume(token string, s *Session, seq uint64) ([]envelope, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	old, ok := h.parked[token]
+	if !ok || h.closed() {
+		return nil, false
+	}
+
+	replay, ok := old.resume.since(seq)
+	if !ok {
+		return nil, false
+	}
+
+	delete(h.parked, token)
+	old.resume.handover(s)
+
+	s.inherit(old)
+	s.id = old.id
+	s.resume = old.resume
+	s.rooms = old.rooms
+	old.rooms = nil
+
+	h.sessions[s] = struct{}{}
+	h.ids[s.id] = s
+	h.tokens[token] = s
+	h.active.Add(1)
+
+	for room := range s.rooms {
+		members := h.rooms[room]
+		delete(members, old)
+		members[s] = struct{}{}
+	}
+
+	return replay, true
+}
+
+func (h *hub) get(id string) (*Session, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.ids[id]
+	return s, ok
+}
+
+func (h *hub) join(s *Session, room string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.sessions[s]; !ok {
+		return false
+	}
+
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*Session]struct{})
+		h.rooms[room] = members
+	}
+	members[s] = struct{}{}
+
+	if s.rooms == nil {
+		s.rooms = make(map[string]struct{})
+	}
+	s.rooms[room] = struct{}{}
+
+	return true
 }
 
-func (h *hub) exit(msg envelope) {
+func (h *hub) part(s *Session, room string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.leave(s, room)
+}
+
+// leave removes s from room, h.mu must be held.
+func (h *hub) leave(s *Session, room string) {
+	if members, ok := h.rooms[room]; ok {
+		delete(members, s)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	delete(s.rooms, room)
+}
+
+func (h *hub) roomNames() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]string, 0, len(h.rooms))
+	for room, members := range h.rooms {
+		for s := range members {
+			if !s.parked {
+				result = append(result, room)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func (h *hub) roomSessions(room string) []*Session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	members := h.rooms[room]
+	result := make([]*Session, 0, len(members))
+	for s := range members {
+		if !s.parked {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (h *hub) sessionRooms(s *Session) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		result = append(result, room)
+	}
+	return result
+}
+
+func (h *hub) exit(msg envelope) []*Session {
+	h.mu.Lock()
+
+	result := make([]*Session, 0, len(h.sessions))
 	for s := range h.sessions {
-		s.writeMessage(msg)
-		s.Close()
+		s.rooms = nil
+		result = append(result, s)
 	}
+	for _, s := range h.parked {
+		s.resume.release()
+		s.rooms = nil
+	}
+
 	h.sessions = make(map[*Session]struct{})
+	h.ids = make(map[string]*Session)
+	h.parked = make(map[string]*Session)
+	h.tokens = make(map[string]*Session)
+	h.rooms = make(map[string]map[*Session]struct{})
 	h.open.Store(false)
+
+	h.mu.Unlock()
+
+	msg.prepared = &prepared{}
+
+	for _, s := range result {
+		s.writeMessage(msg)
+		s.Close()
+	}
+
+	return result
 }
 
-func (h *hub) broadcast(msg envelope) {
+func (h *hub) broadcast(msg envelope) int {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
 
+	live := make([]*Session, 0, len(h.sessions))
 	for s := range h.sessions {
+		live = append(live, s)
+	}
+	parked := make([]*Session, 0, len(h.parked))
+	for _, s := range h.parked {
+		parked = append(parked, s)
+	}
+
+	h.mu.RUnlock()
+
+	return deliver(msg, live, parked)
+}
+
+func (h *hub) broadcastRoom(room string, msg envelope) int {
+	h.mu.RLock()
+
+	live := make([]*Session, 0, len(h.rooms[room]))
+	var parked []*Session
+	for s := range h.rooms[room] {
+		if s.parked {
+			parked = append(parked, s)
+		} else {
+			live = append(live, s)
+		}
+	}
+
+	h.mu.RUnlock()
+
+	return deliver(msg, live, parked)
+}
+
+// deliver writes msg to the live and parked sessions that pass its filter and returns how many
+// live sessions it was written to. It runs without h.mu held so that a session with a full
+// buffer holds up only the caller, not the hub.
+func deliver(msg envelope, live, parked []*Session) int {
+	msg.prepared = &prepared{}
+
+	n := 0
+	for _, s := range live {
+		if msg.filter == nil || msg.filter(s) {
+			s.writeMessage(msg)
+			n++
+		}
+	}
+	for _, s := range parked {
 		if msg.filter == nil || msg.filter(s) {
 			s.writeMessage(msg)
 		}
 	}
+	return n
 }
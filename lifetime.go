@@ -0,0 +1,38 @@
+package melody
+
+import (
+	"math/rand"
+	"time"
+)
+
+// lifetime returns how long a new session may stay connected, Config.MaxSessionLifetime plus
+// up to Config.LifetimeJitter, or 0 if sessions may stay connected forever.
+func (m *Melody) lifetime() time.Duration {
+	lifetime := m.Config.MaxSessionLifetime
+
+	if lifetime <= 0 {
+		return 0
+	}
+
+	if jitter := m.Config.LifetimeJitter; jitter > 0 {
+		lifetime += time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+
+	return lifetime
+}
+
+// active records that the session sent or received a message.
+func (s *Session) active() {
+	s.lastActive.Store(s.melody.now().UnixNano())
+}
+
+// idleWait returns how long until the session has been idle for Config.IdleTimeout, 0 if it already has.
+func (s *Session) idleWait() time.Duration {
+	idle := s.melody.now().Sub(time.Unix(0, s.lastActive.Load()))
+
+	if wait := s.melody.Config.IdleTimeout - idle; wait > 0 {
+		return wait
+	}
+
+	return 0
+}
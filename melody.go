@@ -1,7 +1,9 @@
 package melody
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -25,16 +27,30 @@ const (
 	CloseTLSHandshake            = 1015
 )
 
+// Message types defined in RFC 6455, section 11.8.
+// Duplicate of types from gorilla/websocket for convenience.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
 type handleMessageFunc func(*Session, []byte)
 type handleErrorFunc func(*Session, error)
 type handleCloseFunc func(*Session, int, string) error
 type handleSessionFunc func(*Session)
+type handleDisconnectFunc func(*Session, CloseReason)
+type handleCallFunc func(*Session, *Call)
+type handleRateLimitFunc func(*Session, RateLimitViolation)
+type handlePanicFunc func(*Session, any, []byte)
+type handleExpiringFunc func(*Session, time.Time)
 type filterFunc func(*Session) bool
 
 // Melody implements a websocket manager.
 type Melody struct {
 	Config                   *Config
 	Upgrader                 *websocket.Upgrader
+	Authenticator            Authenticator
+	MessageAuthenticator     MessageAuthenticator
 	messageHandler           handleMessageFunc
 	messageHandlerBinary     handleMessageFunc
 	messageSentHandler       handleMessageFunc
@@ -42,9 +58,25 @@ type Melody struct {
 	errorHandler             handleErrorFunc
 	closeHandler             handleCloseFunc
 	connectHandler           handleSessionFunc
-	disconnectHandler        handleSessionFunc
+	disconnectHandler        handleDisconnectFunc
 	pongHandler              handleSessionFunc
 	hub                      *hub
+	node                     string
+	backplane                Backplane
+	unsubscribe              func()
+	events                   map[string]eventHandlerFunc
+	callHandler              handleCallFunc
+	rateLimitHandler         handleRateLimitFunc
+	rateLimits               rateLimits
+	panicHandler             handlePanicFunc
+	expiringHandler          handleExpiringFunc
+	resumeHandler            handleSessionFunc
+	presence                 *Presence
+	presenceHandler          func(PresenceEvent)
+	transports               transports
+	middleware               []Middleware
+	handler                  HandlerFunc
+	pool                     pool
 }
 
 // New creates a new melody instance with default Upgrader and Config.
@@ -55,7 +87,7 @@ func New() *Melody {
 		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
 
-	return &Melody{
+	m := &Melody{
 		Config:                   newConfig(),
 		Upgrader:                 upgrader,
 		messageHandler:           func(*Session, []byte) {},
@@ -65,10 +97,23 @@ func New() *Melody {
 		errorHandler:             func(*Session, error) {},
 		closeHandler:             nil,
 		connectHandler:           func(*Session) {},
-		disconnectHandler:        func(*Session) {},
+		disconnectHandler:        func(*Session, CloseReason) {},
 		pongHandler:              func(*Session) {},
 		hub:                      newHub(),
+		node:                     randomID(),
+		events:                   make(map[string]eventHandlerFunc),
+		rateLimitHandler:         func(*Session, RateLimitViolation) {},
+		expiringHandler:          func(*Session, time.Time) {},
+		presenceHandler:          func(PresenceEvent) {},
 	}
+
+	m.handler = m.dispatch
+	m.presence = newPresence(m)
+	m.panicHandler = func(s *Session, v any, stack []byte) {
+		m.errorHandler(s, &PanicError{Value: v, Stack: stack})
+	}
+
+	return m
 }
 
 // HandleConnect fires fn when a session connects.
@@ -76,8 +121,24 @@ func (m *Melody) HandleConnect(fn func(*Session)) {
 	m.connectHandler = fn
 }
 
+// HandleResume fires fn instead of the connect handler when a session resumes a disconnected
+// session, see Config.ResumeWindow. The session has the id, keys and rooms of the session it
+// resumes and the messages it missed have been written to it. If no resume handler is set the
+// connect handler fires.
+func (m *Melody) HandleResume(fn func(*Session)) {
+	m.resumeHandler = fn
+}
+
 // HandleDisconnect fires fn when a session disconnects.
 func (m *Melody) HandleDisconnect(fn func(*Session)) {
+	m.disconnectHandler = func(s *Session, _ CloseReason) {
+		fn(s)
+	}
+}
+
+// HandleDisconnectWithReason fires fn with the reason when a session disconnects. It replaces
+// the handler set with HandleDisconnect.
+func (m *Melody) HandleDisconnectWithReason(fn func(*Session, CloseReason)) {
 	m.disconnectHandler = fn
 }
 
@@ -87,11 +148,13 @@ func (m *Melody) HandlePong(fn func(*Session)) {
 }
 
 // HandleMessage fires fn when a text message comes in.
+// Text messages handled by an event handler registered with On are not passed to fn.
 // NOTE: by default Melody handles messages sequentially for each
 // session. This has the effect that a message handler exceeding the
 // read deadline (Config.PongWait, by default 1 minute) will time out
 // the session. Concurrent message handling can be turned on by setting
-// Config.ConcurrentMessageHandling to true.
+// Config.ConcurrentMessageHandling to true, or bounded by setting
+// Config.WorkerPoolSize.
 func (m *Melody) HandleMessage(fn func(*Session, []byte)) {
 	m.messageHandler = fn
 }
@@ -101,6 +164,31 @@ func (m *Melody) HandleMessageBinary(fn func(*Session, []byte)) {
 	m.messageHandlerBinary = fn
 }
 
+// HandleCall fires fn when a session sends a request of the form {"id": ..., "data": ...}.
+// Answer the request with Call.Reply.
+func (m *Melody) HandleCall(fn func(*Session, *Call)) {
+	m.callHandler = fn
+}
+
+// HandleRateLimit fires fn when a message from a session exceeds Config.SessionRateLimit or Config.IPRateLimit.
+func (m *Melody) HandleRateLimit(fn func(*Session, RateLimitViolation)) {
+	m.rateLimitHandler = fn
+}
+
+// HandlePanic fires fn with the recovered value and stack trace when a handler
+// called for a session panics. By default panics are reported to HandleError as
+// a *PanicError. Set Config.CloseOnPanic to also close the session.
+func (m *Melody) HandlePanic(fn func(*Session, any, []byte)) {
+	m.panicHandler = fn
+}
+
+// HandleCredentialExpiring fires fn Config.CredentialRefreshWindow before the credentials of a
+// session expire, see Session.SetCredentialExpiry. Use it to ask the client for fresh credentials
+// and call Session.Reauthenticate once they have been verified.
+func (m *Melody) HandleCredentialExpiring(fn func(*Session, time.Time)) {
+	m.expiringHandler = fn
+}
+
 // HandleSentMessage fires fn when a text message is successfully sent.
 func (m *Melody) HandleSentMessage(fn func(*Session, []byte)) {
 	m.messageSentHandler = fn
@@ -136,6 +224,7 @@ func (m *Melody) HandleClose(fn func(*Session, int, string) error) {
 }
 
 // HandleRequest upgrades http requests to websocket connections and dispatches them to be handled by the melody instance.
+// Requests are authenticated with the Authenticator and MessageAuthenticator, if set.
 func (m *Melody) HandleRequest(w http.ResponseWriter, r *http.Request) error {
 	return m.HandleRequestWithKeys(w, r, nil)
 }
@@ -146,37 +235,135 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 		return ErrClosed
 	}
 
-	conn, err := m.Upgrader.Upgrade(w, r, w.Header())
+	principal, err := m.authenticate(w, r)
+
+	if err != nil {
+		return err
+	}
+
+	upgrader := m.upgrader()
+	compressed := negotiatesCompression(upgrader, r)
+
+	var counter *countingWriter
+	if compressed && m.measuresCompression() {
+		counter = &countingWriter{ResponseWriter: w}
+		w = counter
+	}
+
+	conn, err := upgrader.Upgrade(w, r, w.Header())
 
 	if err != nil {
 		return err
 	}
 
-	session := &Session{
+	if m.Config.CompressionLevel != 0 {
+		conn.SetCompressionLevel(m.Config.CompressionLevel)
+	}
+
+	session := m.newSession(r, keys, conn, principal)
+	session.compressed = compressed
+	if counter != nil {
+		session.wire = counter.conn
+	}
+
+	return m.serve(session)
+}
+
+func (m *Melody) newSession(r *http.Request, keys map[string]any, conn Conn, principal any) *Session {
+	return &Session{
 		Request:    r,
 		Keys:       keys,
+		id:         m.Config.SessionIDGenerator(r),
 		conn:       conn,
 		output:     make(chan envelope, m.Config.MessageBufferSize),
 		outputDone: make(chan struct{}),
 		melody:     m,
 		open:       true,
+		limiter:    newLimiter(m.Config.SessionRateLimit, m.now()),
+		principal:  principal,
+		creds: credentials{
+			changed: make(chan struct{}, 1),
+		},
+	}
+}
+
+// serve runs session until it disconnects.
+func (m *Melody) serve(session *Session) error {
+	r, conn := session.Request, session.conn
+
+	if err := session.authenticateMessage(); err != nil {
+		return err
+	}
+
+	if n := m.maxInFlight(); n > 0 {
+		session.inflight = make(chan struct{}, n)
+	}
+
+	ip := remoteIP(r)
+	session.ipLimiter = m.rateLimits.acquire(ip, m.Config.IPRateLimit, m.now())
+	defer m.rateLimits.release(ip, session.ipLimiter)
+
+	var replay []envelope
+	var seq uint64
+	var resumed bool
+
+	if m.Config.ResumeWindow > 0 {
+		session.detached = make(chan struct{})
+
+		if replay, seq, resumed = m.resume(session); !resumed {
+			session.resume = newResumption(session)
+		}
 	}
 
-	m.hub.register(session)
+	if !resumed && !m.hub.register(session) {
+		conn.Close()
+		return ErrClosed
+	}
 
-	m.connectHandler(session)
+	defer m.hub.active.Done()
 
-	go session.writePump()
+	m.Config.Metrics.SessionConnected()
+
+	if session.resume != nil {
+		if err := session.greet(seq, replay); err != nil {
+			m.errorHandler(session, err)
+		}
+	}
+
+	if resumed {
+		session.handle(EventResume, nil)
+	} else {
+		session.handle(EventConnect, nil)
+	}
+
+	m.presence.track(session)
+
+	pumped := make(chan struct{})
+
+	go func() {
+		session.writePump()
+		close(pumped)
+	}()
 
 	session.readPump()
 
-	if !m.hub.closed() {
+	if session.resume != nil {
+		session.close()
+		<-pumped
+		session.retainBuffered()
+		m.park(session)
+		close(session.detached)
+	} else if !m.hub.closed() {
 		m.hub.unregister(session)
 	}
 
 	session.close()
 
-	m.disconnectHandler(session)
+	m.presence.untrack(session)
+
+	session.handle(EventDisconnect, nil)
+
+	m.Config.Metrics.SessionDisconnected()
 
 	return nil
 }
@@ -188,19 +375,19 @@ func (m *Melody) Broadcast(msg []byte) error {
 	}
 
 	message := envelope{t: websocket.TextMessage, msg: msg}
-	m.hub.broadcast(message)
 
-	return nil
+	return m.broadcast(message, "")
 }
 
 // BroadcastFilter broadcasts a text message to all sessions that fn returns true for.
+// Filtered broadcasts only reach sessions connected to this instance, they are not published to the backplane.
 func (m *Melody) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
 	if m.hub.closed() {
 		return ErrClosed
 	}
 
 	message := envelope{t: websocket.TextMessage, msg: msg, filter: fn}
-	m.hub.broadcast(message)
+	m.Config.Metrics.Broadcast(message.t, len(message.msg), m.hub.broadcast(message))
 
 	return nil
 }
@@ -214,11 +401,18 @@ func (m *Melody) BroadcastOthers(msg []byte, s *Session) error {
 
 // BroadcastMultiple broadcasts a text message to multiple sessions given in the sessions slice.
 func (m *Melody) BroadcastMultiple(msg []byte, sessions []*Session) error {
+	message := envelope{t: websocket.TextMessage, msg: msg, prepared: &prepared{}}
+
 	for _, sess := range sessions {
-		if writeErr := sess.Write(msg); writeErr != nil {
-			return writeErr
+		if sess.closed() {
+			return ErrSessionClosed
 		}
+
+		sess.writeMessage(message)
 	}
+
+	m.Config.Metrics.Broadcast(message.t, len(message.msg), len(sessions))
+
 	return nil
 }
 
@@ -229,19 +423,19 @@ func (m *Melody) BroadcastBinary(msg []byte) error {
 	}
 
 	message := envelope{t: websocket.BinaryMessage, msg: msg}
-	m.hub.broadcast(message)
 
-	return nil
+	return m.broadcast(message, "")
 }
 
 // BroadcastBinaryFilter broadcasts a binary message to all sessions that fn returns true for.
+// Filtered broadcasts only reach sessions connected to this instance, they are not published to the backplane.
 func (m *Melody) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error {
 	if m.hub.closed() {
 		return ErrClosed
 	}
 
 	message := envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	m.hub.broadcast(message)
+	m.Config.Metrics.Broadcast(message.t, len(message.msg), m.hub.broadcast(message))
 
 	return nil
 }
@@ -253,6 +447,97 @@ func (m *Melody) BroadcastBinaryOthers(msg []byte, s *Session) error {
 	})
 }
 
+// BroadcastRoom broadcasts a text message to all sessions in room.
+func (m *Melody) BroadcastRoom(room string, msg []byte) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	message := envelope{t: websocket.TextMessage, msg: msg}
+
+	return m.broadcast(message, room)
+}
+
+// BroadcastBinaryRoom broadcasts a binary message to all sessions in room.
+func (m *Melody) BroadcastBinaryRoom(room string, msg []byte) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	message := envelope{t: websocket.BinaryMessage, msg: msg}
+
+	return m.broadcast(message, room)
+}
+
+// RoomSessions returns all sessions in room. An error is returned if the melody session is closed.
+func (m *Melody) RoomSessions(room string) ([]*Session, error) {
+	if m.hub.closed() {
+		return nil, ErrClosed
+	}
+	return m.hub.roomSessions(room), nil
+}
+
+// Rooms returns the names of all rooms with at least one session. An error is returned if the melody session is closed.
+func (m *Melody) Rooms() ([]string, error) {
+	if m.hub.closed() {
+		return nil, ErrClosed
+	}
+	return m.hub.roomNames(), nil
+}
+
+// Session returns the session with the given id. An error is returned if the melody session is closed
+// or no session with that id is connected to this instance.
+func (m *Melody) Session(id string) (*Session, error) {
+	if m.hub.closed() {
+		return nil, ErrClosed
+	}
+
+	if s, ok := m.hub.get(id); ok {
+		return s, nil
+	}
+
+	return nil, ErrSessionNotFound
+}
+
+// SendTo writes a text message to the session with the given id. If the session is not connected to
+// this instance the message is published to the backplane, if there is one.
+func (m *Melody) SendTo(id string, msg []byte) error {
+	return m.sendTo(id, envelope{t: websocket.TextMessage, msg: msg})
+}
+
+// SendBinaryTo writes a binary message to the session with the given id. If the session is not connected to
+// this instance the message is published to the backplane, if there is one.
+func (m *Melody) SendBinaryTo(id string, msg []byte) error {
+	return m.sendTo(id, envelope{t: websocket.BinaryMessage, msg: msg})
+}
+
+func (m *Melody) sendTo(id string, message envelope) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	if s, ok := m.hub.get(id); ok {
+		if s.closed() {
+			return ErrSessionClosed
+		}
+
+		s.writeMessage(message)
+
+		return nil
+	}
+
+	if m.backplane == nil {
+		return ErrSessionNotFound
+	}
+
+	return m.backplane.Publish(&BackplaneMessage{
+		Origin:  m.node,
+		Type:    message.t,
+		Payload: message.msg,
+		Session: id,
+	})
+}
+
 // Sessions returns all sessions. An error is returned if the melody session is closed.
 func (m *Melody) Sessions() ([]*Session, error) {
 	if m.hub.closed() {
@@ -261,17 +546,132 @@ func (m *Melody) Sessions() ([]*Session, error) {
 	return m.hub.all(), nil
 }
 
+// SetBackplane attaches the melody instance to b. Broadcast, BroadcastBinary and
+// the room broadcasts are then delivered to sessions on every instance attached
+// to the same backplane. It should be called before handling any requests.
+func (m *Melody) SetBackplane(b Backplane) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	unsubscribe, err := b.Subscribe(m.receive)
+
+	if err != nil {
+		return err
+	}
+
+	if m.unsubscribe != nil {
+		m.unsubscribe()
+	}
+
+	m.backplane = b
+	m.unsubscribe = unsubscribe
+
+	return nil
+}
+
+func (m *Melody) broadcast(message envelope, room string) error {
+	m.deliver(message, room)
+
+	if m.backplane == nil {
+		return nil
+	}
+
+	return m.backplane.Publish(&BackplaneMessage{
+		Origin:   m.node,
+		Type:     message.t,
+		Payload:  message.msg,
+		Room:     room,
+		Key:      message.key,
+		Compress: message.compress,
+	})
+}
+
+func (m *Melody) receive(msg *BackplaneMessage) {
+	if msg.Origin == m.node || m.hub.closed() {
+		return
+	}
+
+	message := envelope{t: msg.Type, msg: msg.Payload, key: msg.Key, compress: msg.Compress}
+
+	if msg.Session != "" {
+		if s, ok := m.hub.get(msg.Session); ok {
+			s.writeMessage(message)
+		}
+		return
+	}
+
+	m.deliver(message, msg.Room)
+}
+
+// deliver broadcasts message to the sessions in room, or all sessions if room is empty, on this instance.
+func (m *Melody) deliver(message envelope, room string) {
+	var n int
+
+	if room == "" {
+		n = m.hub.broadcast(message)
+	} else {
+		n = m.hub.broadcastRoom(room, message)
+	}
+
+	m.Config.Metrics.Broadcast(message.t, len(message.msg), n)
+}
+
+func (m *Melody) detach() {
+	if m.unsubscribe != nil {
+		m.unsubscribe()
+	}
+}
+
 // Close closes the melody instance and all connected sessions.
 func (m *Melody) Close() error {
 	if m.hub.closed() {
 		return ErrClosed
 	}
 
+	m.detach()
+
 	m.hub.exit(envelope{t: websocket.CloseMessage, msg: []byte{}})
+	m.pool.close()
 
 	return nil
 }
 
+// Shutdown gracefully closes the melody instance. It stops accepting new sessions,
+// sends a close message with Config.ShutdownCloseCode to every session after the
+// messages already buffered for it, and waits for all sessions to disconnect and
+// their disconnect handlers to return. If ctx expires first the remaining sessions
+// are closed without waiting for their buffers to drain and ctx.Err() is returned.
+func (m *Melody) Shutdown(ctx context.Context) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	m.detach()
+
+	sessions := m.hub.exit(envelope{t: websocket.CloseMessage, msg: FormatCloseMessage(m.Config.ShutdownCloseCode, "")})
+
+	done := make(chan struct{})
+
+	go func() {
+		m.hub.active.Wait()
+		close(done)
+	}()
+
+	defer m.pool.close()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, s := range sessions {
+			s.setCloseReason(CloseReason{Initiator: InitiatorServer, Code: CloseAbnormalClosure, Err: ctx.Err()})
+			s.close()
+		}
+		return ctx.Err()
+	}
+}
+
 // CloseWithMsg closes the melody instance with the given close payload and all connected sessions.
 // Use the FormatCloseMessage function to format a proper close message payload.
 func (m *Melody) CloseWithMsg(msg []byte) error {
@@ -279,7 +679,10 @@ func (m *Melody) CloseWithMsg(msg []byte) error {
 		return ErrClosed
 	}
 
+	m.detach()
+
 	m.hub.exit(envelope{t: websocket.CloseMessage, msg: msg})
+	m.pool.close()
 
 	return nil
 }
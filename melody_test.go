@@ -1,9 +1,13 @@
 package melody
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -407,27 +411,6 @@ func TestSessions(t *testing.T) {
 	assert.Equal(t, len(ss), connected)
 }
 
-func TestPingPong(t *testing.T) {
-	done := make(chan bool)
-
-	ws := NewTestServer()
-	ws.m.Config.PingPeriod = time.Millisecond
-
-	ws.m.HandlePong(func(s *Session) {
-		close(done)
-	})
-
-	server := httptest.NewServer(ws)
-	defer server.Close()
-
-	conn := MustNewDialer(server.URL)
-	defer conn.Close()
-
-	go conn.NextReader()
-
-	<-done
-}
-
 func TestHandleClose(t *testing.T) {
 	done := make(chan bool)
 
@@ -847,3 +830,2142 @@ func TestConcurrentMessageHandling(t *testing.T) {
 		}
 	})
 }
+
+func TestRooms(t *testing.T) {
+	joined := make(chan *Session)
+	left := make(chan *Session, 3)
+
+	ws := NewTestServer()
+
+	ws.m.HandleConnect(func(s *Session) {
+		assert.Nil(t, s.Join(s.Request.URL.Query().Get("room")))
+		joined <- s
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		left <- s
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	a1 := MustNewDialer(server.URL + "?room=a")
+	defer a1.Close()
+	<-joined
+
+	a2 := MustNewDialer(server.URL + "?room=a")
+	defer a2.Close()
+	<-joined
+
+	b1 := MustNewDialer(server.URL + "?room=b")
+	<-joined
+
+	rooms, err := ws.m.Rooms()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, rooms)
+
+	ss, err := ws.m.RoomSessions("a")
+	assert.Nil(t, err)
+	assert.Len(t, ss, 2)
+	assert.Equal(t, []string{"a"}, ss[0].Rooms())
+
+	assert.Nil(t, ws.m.BroadcastRoom("a", TestMsg))
+	assert.Nil(t, ws.m.BroadcastBinaryRoom("b", []byte("b")))
+
+	for _, conn := range []*websocket.Conn{a1, a2} {
+		typ, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, websocket.TextMessage, typ)
+		assert.Equal(t, TestMsg, ret)
+	}
+
+	typ, ret, err := b1.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, typ)
+	assert.Equal(t, []byte("b"), ret)
+
+	b1.Close()
+	<-left
+
+	rooms, err = ws.m.Rooms()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, rooms)
+
+	assert.Nil(t, ss[0].Leave("a"))
+	assert.Empty(t, ss[0].Rooms())
+
+	ss, err = ws.m.RoomSessions("a")
+	assert.Nil(t, err)
+	assert.Len(t, ss, 1)
+
+	ws.m.Close()
+
+	_, err = ws.m.Rooms()
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = ws.m.RoomSessions("a")
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, ws.m.BroadcastRoom("a", TestMsg), ErrClosed)
+	assert.ErrorIs(t, ws.m.BroadcastBinaryRoom("a", TestMsg), ErrClosed)
+	assert.ErrorIs(t, ss[0].Join("a"), ErrSessionClosed)
+}
+
+func TestBackplane(t *testing.T) {
+	test := func(a, b Backplane) {
+		joined := make(chan bool)
+
+		nodes := []*TestServer{NewTestServer(), NewTestServer()}
+		conns := make([]*websocket.Conn, len(nodes))
+
+		for i, ws := range nodes {
+			ws.m.HandleConnect(func(s *Session) {
+				s.Join("room")
+				joined <- true
+			})
+
+			server := httptest.NewServer(ws)
+			defer server.Close()
+
+			conns[i] = MustNewDialer(server.URL)
+			defer conns[i].Close()
+			<-joined
+		}
+
+		assert.Nil(t, nodes[0].m.SetBackplane(a))
+		assert.Nil(t, nodes[1].m.SetBackplane(b))
+
+		assert.Nil(t, nodes[0].m.Broadcast([]byte("all")))
+		assert.Nil(t, nodes[1].m.BroadcastRoom("room", []byte("room")))
+		assert.Nil(t, nodes[1].m.BroadcastRoom("other", []byte("other")))
+		assert.Nil(t, nodes[0].m.BroadcastBinary([]byte("binary")))
+
+		for _, conn := range conns {
+			var got []string
+			for i := 0; i < 3; i++ {
+				_, ret, err := conn.ReadMessage()
+				assert.Nil(t, err)
+				got = append(got, string(ret))
+			}
+			assert.ElementsMatch(t, []string{"all", "room", "binary"}, got)
+		}
+
+		nodes[1].m.Close()
+
+		assert.Nil(t, nodes[0].m.Broadcast([]byte("closed")))
+		_, ret, err := conns[0].ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "closed", string(ret))
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		b := NewMemoryBackplane()
+		test(b, b)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		server, err := ListenTCPBackplane("127.0.0.1:0")
+		assert.Nil(t, err)
+		defer server.Close()
+
+		a, err := DialTCPBackplane(server.Addr().String())
+		assert.Nil(t, err)
+		defer a.Close()
+
+		b, err := DialTCPBackplane(server.Addr().String())
+		assert.Nil(t, err)
+		defer b.Close()
+
+		test(a, b)
+
+		a.Close()
+		<-a.done
+		assert.ErrorIs(t, a.Publish(&BackplaneMessage{}), ErrBackplaneClosed)
+		_, err = a.Subscribe(func(*BackplaneMessage) {})
+		assert.ErrorIs(t, err, ErrBackplaneClosed)
+	})
+
+	t.Run("tcp slow peer", func(t *testing.T) {
+		server, err := ListenTCPBackplane("127.0.0.1:0")
+		assert.Nil(t, err)
+
+		stuck, err := net.Dial("tcp", server.Addr().String())
+		assert.Nil(t, err)
+		defer stuck.Close()
+
+		a, err := DialTCPBackplane(server.Addr().String())
+		assert.Nil(t, err)
+		defer a.Close()
+
+		n := 2 * tcpBackplaneQueueSize
+		received := make(chan bool, n)
+		a.Subscribe(func(*BackplaneMessage) {
+			received <- true
+		})
+
+		msg := &BackplaneMessage{Payload: bytes.Repeat([]byte("x"), 16<<10)}
+		for i := 0; i < n; i++ {
+			assert.Nil(t, a.Publish(msg))
+		}
+
+		for i := 0; i < n; i++ {
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("relayed %d of %d messages", i, n)
+			}
+		}
+
+		closed := make(chan bool)
+		go func() {
+			server.Close()
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("close blocked on a slow peer")
+		}
+	})
+}
+
+func TestSessionID(t *testing.T) {
+	ss := make(chan *Session)
+
+	ws := NewTestServer()
+
+	var counter atomic.Int64
+	ws.m.Config.SessionIDGenerator = func(r *http.Request) string {
+		return strconv.Itoa(int(counter.Add(1)))
+	}
+
+	ws.m.HandleConnect(func(s *Session) {
+		ss <- s
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn1 := MustNewDialer(server.URL)
+	defer conn1.Close()
+	s1 := <-ss
+
+	conn2 := MustNewDialer(server.URL)
+	defer conn2.Close()
+	s2 := <-ss
+
+	assert.Equal(t, "1", s1.ID())
+	assert.Equal(t, "2", s2.ID())
+
+	s, err := ws.m.Session("2")
+	assert.Nil(t, err)
+	assert.Equal(t, s2, s)
+
+	_, err = ws.m.Session("3")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	assert.Nil(t, ws.m.SendTo("1", TestMsg))
+	assert.Nil(t, ws.m.SendBinaryTo("2", TestMsg))
+	assert.ErrorIs(t, ws.m.SendTo("3", TestMsg), ErrSessionNotFound)
+
+	typ, ret, err := conn1.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.TextMessage, typ)
+	assert.Equal(t, TestMsg, ret)
+
+	typ, ret, err = conn2.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, websocket.BinaryMessage, typ)
+	assert.Equal(t, TestMsg, ret)
+
+	ws.m.Close()
+
+	_, err = ws.m.Session("1")
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, ws.m.SendTo("1", TestMsg), ErrClosed)
+}
+
+func TestSessionIDBackplane(t *testing.T) {
+	ss := make(chan *Session)
+
+	b := NewMemoryBackplane()
+	nodes := []*TestServer{NewTestServer(), NewTestServer()}
+	conns := make([]*websocket.Conn, len(nodes))
+	sessions := make([]*Session, len(nodes))
+
+	for i, ws := range nodes {
+		assert.Nil(t, ws.m.SetBackplane(b))
+
+		ws.m.HandleConnect(func(s *Session) {
+			ss <- s
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conns[i] = MustNewDialer(server.URL)
+		defer conns[i].Close()
+		sessions[i] = <-ss
+	}
+
+	assert.NotEqual(t, sessions[0].ID(), sessions[1].ID())
+
+	assert.Nil(t, nodes[0].m.SendTo(sessions[1].ID(), []byte("remote")))
+	assert.Nil(t, nodes[0].m.SendTo(sessions[0].ID(), []byte("local")))
+
+	_, ret, err := conns[1].ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "remote", string(ret))
+
+	_, ret, err = conns[0].ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "local", string(ret))
+}
+
+func TestEvents(t *testing.T) {
+	type chat struct {
+		Text string `json:"text"`
+	}
+
+	errs := make(chan error, 1)
+
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(append([]byte("raw "), msg...))
+	})
+
+	On(ws.m, "chat.send", func(s *Session, c chat) error {
+		return s.Emit("chat.ack", c)
+	})
+
+	On(ws.m, "chat.broadcast", func(s *Session, c chat) error {
+		return ws.m.BroadcastEvent("chat.message", c)
+	})
+
+	failure := errors.New("failure")
+	On(ws.m, "fail", func(s *Session, _ struct{}) error {
+		return failure
+	})
+
+	ws.m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	roundtrip := func(msg string) string {
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		return string(ret)
+	}
+
+	assert.JSONEq(t, `{"type":"chat.ack","data":{"text":"hi"}}`, roundtrip(`{"type":"chat.send","data":{"text":"hi"}}`))
+	assert.JSONEq(t, `{"type":"chat.message","data":{"text":"all"}}`, roundtrip(`{"type":"chat.broadcast","data":{"text":"all"}}`))
+	assert.Equal(t, "raw plain", roundtrip("plain"))
+	assert.Equal(t, `raw {"type":"unknown"}`, roundtrip(`{"type":"unknown"}`))
+
+	var eventErr *EventError
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat.send","data":1}`))
+	err := <-errs
+	assert.ErrorAs(t, err, &eventErr)
+	assert.Equal(t, "chat.send", eventErr.Event)
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"fail"}`))
+	err = <-errs
+	assert.ErrorAs(t, err, &eventErr)
+	assert.Equal(t, "fail", eventErr.Event)
+	assert.ErrorIs(t, err, failure)
+}
+
+func TestSendRequest(t *testing.T) {
+	ss := make(chan *Session)
+
+	ws := NewTestServer()
+	ws.m.Config.RequestTimeout = 50 * time.Millisecond
+
+	ws.m.HandleConnect(func(s *Session) {
+		ss <- s
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	s := <-ss
+
+	_, err := s.SendRequest(context.Background(), []byte("not json"))
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+
+	res := make(chan []byte)
+	go func() {
+		data, err := s.SendRequest(context.Background(), []byte(`{"lock":"x"}`))
+		assert.Nil(t, err)
+		res <- data
+	}()
+
+	var req struct {
+		ID   string          `json:"id"`
+		Data json.RawMessage `json:"data"`
+	}
+	assert.Nil(t, conn.ReadJSON(&req))
+	assert.JSONEq(t, `{"lock":"x"}`, string(req.Data))
+
+	conn.WriteJSON(map[string]any{"reply_to": req.ID, "data": true})
+	assert.Equal(t, []byte("true"), <-res)
+
+	_, err = s.SendRequest(context.Background(), []byte(`1`))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, conn.ReadJSON(&req))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.SendRequest(ctx, []byte(`2`))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, conn.ReadJSON(&req))
+
+	go func() {
+		_, err := s.SendRequest(context.Background(), []byte(`3`))
+		res <- nil
+		assert.ErrorIs(t, err, ErrSessionClosed)
+	}()
+
+	assert.Nil(t, conn.ReadJSON(&req))
+	conn.Close()
+	<-res
+}
+
+func TestHandleCall(t *testing.T) {
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+
+	ws.m.HandleCall(func(s *Session, c *Call) {
+		assert.ErrorIs(t, c.Reply([]byte("not json")), ErrInvalidPayload)
+		assert.Nil(t, c.Reply(c.Data))
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"a","data":[1,2]}`))
+
+	_, ret, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"reply_to":"a","data":[1,2]}`, string(ret))
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"reply_to":"a"}`))
+
+	_, ret, err = conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"reply_to":"a"}`, string(ret))
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	test := func(policy OverflowPolicy, connect func(*Session), want ...string) {
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			s.Write(msg)
+		})
+		ws.m.Config.MessageBufferSize = 2
+		ws.m.Config.OverflowPolicy = policy
+		ws.m.Config.OverflowTimeout = time.Second
+		ws.m.HandleConnect(connect)
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		for _, msg := range want {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, msg, string(ret))
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte("end"))
+
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "end", string(ret))
+	}
+
+	write := func(msgs ...string) func(*Session) {
+		return func(s *Session) {
+			for _, msg := range msgs {
+				s.Write([]byte(msg))
+			}
+		}
+	}
+
+	test(OverflowDropNewest, write("1", "2", "3"), "1", "2")
+	test(OverflowDropOldest, write("1", "2", "3"), "2", "3")
+	test(OverflowBlock, func(s *Session) {
+		go write("1", "2", "3")(s)
+	}, "1", "2", "3")
+	test(OverflowCoalesce, func(s *Session) {
+		s.WriteKeyed("a", []byte("1"))
+		s.WriteKeyed("b", []byte("x"))
+		s.WriteKeyed("a", []byte("2"))
+		s.Write([]byte("3"))
+	}, "2", "x")
+	test(OverflowDropNewest, func(s *Session) {
+		s.WriteKeyed("a", []byte("1"))
+		s.WriteKeyed("a", []byte("2"))
+	}, "1", "2")
+
+	ws := NewTestServer()
+	ws.m.Config.MessageBufferSize = 2
+	ws.m.Config.OverflowPolicy = OverflowClose
+	ws.m.HandleConnect(write("1", "2", "3"))
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	// Buffered messages may arrive before the close message.
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, CloseTryAgainLater))
+
+	ws = NewTestServer()
+	ws.m.Config.MessageBufferSize = 2
+	ws.m.Config.OverflowPolicy = OverflowDropOldest
+	ws.m.HandleConnect(func(s *Session) {
+		s.Write([]byte("1"))
+		s.CloseWithMsg(FormatCloseMessage(CloseGoingAway, ""))
+		s.Write([]byte("2"))
+		s.Write([]byte("3"))
+	})
+
+	server = httptest.NewServer(ws)
+	defer server.Close()
+
+	conn = MustNewDialer(server.URL)
+	defer conn.Close()
+
+	_, ret, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(ret))
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseGoingAway))
+}
+
+func TestShutdown(t *testing.T) {
+	joined := make(chan bool)
+	var disconnected atomic.Int32
+
+	ws := NewTestServer()
+
+	ws.m.HandleConnect(func(s *Session) {
+		joined <- true
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		time.Sleep(10 * time.Millisecond)
+		disconnected.Add(1)
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	n := 3
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		conns[i] = MustNewDialer(server.URL)
+		defer conns[i].Close()
+		<-joined
+	}
+
+	assert.Nil(t, ws.m.Broadcast(TestMsg))
+	assert.Nil(t, ws.m.Shutdown(context.Background()))
+	assert.Equal(t, int32(n), disconnected.Load())
+	assert.ErrorIs(t, ws.m.Shutdown(context.Background()), ErrClosed)
+
+	for _, conn := range conns {
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, TestMsg, ret)
+
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, CloseServiceRestart))
+	}
+
+	_, err := NewDialer(server.URL)
+	assert.NotNil(t, err)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	joined := make(chan bool)
+	release := make(chan bool)
+
+	ws := NewTestServer()
+
+	ws.m.HandleConnect(func(s *Session) {
+		joined <- true
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		<-release
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+	<-joined
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, ws.m.Shutdown(ctx), context.DeadlineExceeded)
+	close(release)
+}
+
+func TestMetrics(t *testing.T) {
+	pong := make(chan bool, 1)
+	disconnect := make(chan bool)
+
+	metrics := NewMetricsCollector()
+
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+	ws.m.Config.Metrics = metrics
+	ws.m.Config.PingPeriod = 10 * time.Millisecond
+
+	ws.m.HandlePong(func(s *Session) {
+		select {
+		case pong <- true:
+		default:
+		}
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		close(disconnect)
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+
+	conn.WriteMessage(websocket.TextMessage, TestMsg)
+	conn.ReadMessage()
+
+	go conn.NextReader()
+	<-pong
+
+	assert.Nil(t, ws.m.Broadcast(TestMsg))
+	assert.Nil(t, ws.m.BroadcastBinaryFilter(TestMsg, func(*Session) bool { return false }))
+
+	conn.Close()
+	<-disconnect
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, body, "# TYPE melody_sessions gauge\nmelody_sessions 0\n")
+	assert.Contains(t, body, "melody_sessions_total 1\n")
+	assert.Contains(t, body, `melody_messages_received_total{type="text"} 1`+"\n")
+	assert.Contains(t, body, `melody_received_bytes_total{type="text"} 4`+"\n")
+	assert.Contains(t, body, `melody_broadcasts_total{type="text"} 1`+"\n")
+	assert.Contains(t, body, `melody_broadcasts_total{type="binary"} 1`+"\n")
+	assert.Contains(t, body, "melody_broadcast_recipients_total 1\n")
+	assert.Contains(t, body, "melody_messages_dropped_total 0\n")
+	assert.Regexp(t, "melody_ping_rtt_seconds_count [1-9]", body)
+	assert.Regexp(t, `melody_messages_sent_total{type="text"} [1-2]`, body)
+	assert.Contains(t, body, `melody_write_latency_seconds_bucket{le="+Inf"}`)
+	assert.Contains(t, body, "# TYPE melody_buffered_messages histogram\n")
+}
+
+func TestRateLimit(t *testing.T) {
+	test := func(action RateLimitAction, limit func(*Config), send int) (*websocket.Conn, chan RateLimitViolation, func()) {
+		violations := make(chan RateLimitViolation, send)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			s.Write(msg)
+		})
+		limit(ws.m.Config)
+		ws.m.Config.RateLimitAction = action
+		ws.m.Config.RateLimitWarning = []byte("slow down")
+		ws.m.HandleRateLimit(func(s *Session, v RateLimitViolation) {
+			violations <- v
+		})
+
+		server := httptest.NewServer(ws)
+
+		conn := MustNewDialer(server.URL)
+
+		for i := 0; i < send; i++ {
+			conn.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+		}
+
+		return conn, violations, func() {
+			conn.Close()
+			server.Close()
+		}
+	}
+
+	sessionLimit := func(c *Config) {
+		c.SessionRateLimit = RateLimit{Messages: 1, MessageBurst: 2}
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		conn, violations, done := test(RateLimitDrop, sessionLimit, 4)
+		defer done()
+
+		for _, want := range []string{"0", "1"} {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(ret))
+		}
+
+		for i := 0; i < 2; i++ {
+			v := <-violations
+			assert.Equal(t, RateLimitDrop, v.Action)
+			assert.False(t, v.IP)
+			assert.Equal(t, 1, v.Size)
+		}
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		conn, _, done := test(RateLimitWarn, sessionLimit, 3)
+		defer done()
+
+		for _, want := range []string{"0", "1", "slow down"} {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(ret))
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		conn, _, done := test(RateLimitClose, sessionLimit, 3)
+		defer done()
+
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		assert.True(t, websocket.IsCloseError(err, ClosePolicyViolation))
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		start := time.Now()
+
+		conn, violations, done := test(RateLimitDelay, func(c *Config) {
+			c.SessionRateLimit = RateLimit{Messages: 20, MessageBurst: 1}
+		}, 3)
+		defer done()
+
+		for _, want := range []string{"0", "1", "2"} {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(ret))
+		}
+
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+		assert.Len(t, violations, 2)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		conn, violations, done := test(RateLimitDrop, func(c *Config) {
+			c.SessionRateLimit = RateLimit{Bytes: 1, ByteBurst: 2}
+		}, 3)
+		defer done()
+
+		for _, want := range []string{"0", "1"} {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(ret))
+		}
+		<-violations
+	})
+
+	t.Run("ip", func(t *testing.T) {
+		violations := make(chan RateLimitViolation, 4)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			s.Write(msg)
+		})
+		ws.m.Config.IPRateLimit = RateLimit{Messages: 1, MessageBurst: 2}
+		ws.m.HandleRateLimit(func(s *Session, v RateLimitViolation) {
+			violations <- v
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		for i := 0; i < 2; i++ {
+			conn := MustNewDialer(server.URL)
+			defer conn.Close()
+
+			conn.WriteMessage(websocket.TextMessage, TestMsg)
+			conn.WriteMessage(websocket.TextMessage, TestMsg)
+		}
+
+		v := <-violations
+		assert.True(t, v.IP)
+		<-violations
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		panics := make(chan any, 1)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			s.Write(msg)
+		})
+		ws.m.Config.SessionRateLimit = RateLimit{Messages: 1, MessageBurst: 1}
+		ws.m.HandleRateLimit(func(s *Session, v RateLimitViolation) {
+			panic("limited")
+		})
+		ws.m.HandlePanic(func(s *Session, v any, stack []byte) {
+			panics <- v
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+
+		assert.Equal(t, "limited", <-panics)
+
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, TestMsg, ret)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	disconnect := make(chan bool)
+
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(s *Session, kind EventKind, msg []byte) {
+				mu.Lock()
+				trace = append(trace, name+":"+strconv.Itoa(int(kind)))
+				mu.Unlock()
+				next(s, kind, msg)
+			}
+		}
+	}
+
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		close(disconnect)
+	})
+
+	ws.m.Use(record("a"), record("b"))
+	ws.m.Use(func(next HandlerFunc) HandlerFunc {
+		return func(s *Session, kind EventKind, msg []byte) {
+			if string(msg) == "secret" {
+				return
+			}
+			next(s, kind, bytes.ToUpper(msg))
+		}
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+
+	conn.WriteMessage(websocket.TextMessage, []byte("secret"))
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+
+	_, ret, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "HELLO", string(ret))
+
+	conn.Close()
+	<-disconnect
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Equal(t, []string{
+		"a:0", "b:0",
+		"a:2", "b:2",
+		"a:2", "b:2",
+		"a:1", "b:1",
+	}, trace)
+}
+
+func TestHandlePanic(t *testing.T) {
+	test := func(name string, setup func(*TestServer), w func(*websocket.Conn)) {
+		t.Run(name, func(t *testing.T) {
+			panics := make(chan any, 1)
+
+			ws := NewTestServer()
+			ws.m.Config.PingPeriod = 10 * time.Millisecond
+			ws.m.HandlePanic(func(s *Session, v any, stack []byte) {
+				assert.Contains(t, string(stack), "panic")
+				select {
+				case panics <- v:
+				default:
+				}
+			})
+			setup(ws)
+
+			server := httptest.NewServer(ws)
+			defer server.Close()
+
+			conn := MustNewDialer(server.URL)
+			defer conn.Close()
+
+			w(conn)
+
+			assert.Equal(t, name, <-panics)
+		})
+	}
+
+	write := func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+		go conn.NextReader()
+	}
+
+	test("message", func(ws *TestServer) {
+		ws.m.HandleMessage(func(*Session, []byte) { panic("message") })
+	}, write)
+
+	test("concurrent", func(ws *TestServer) {
+		ws.m.Config.ConcurrentMessageHandling = true
+		ws.m.HandleMessage(func(*Session, []byte) { panic("concurrent") })
+	}, write)
+
+	test("binary", func(ws *TestServer) {
+		ws.m.HandleMessageBinary(func(*Session, []byte) { panic("binary") })
+	}, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.BinaryMessage, TestMsg)
+	})
+
+	test("sent", func(ws *TestServer) {
+		ws.m.HandleMessage(func(s *Session, msg []byte) { s.Write(msg) })
+		ws.m.HandleSentMessage(func(*Session, []byte) { panic("sent") })
+	}, write)
+
+	test("connect", func(ws *TestServer) {
+		ws.m.HandleConnect(func(*Session) { panic("connect") })
+	}, func(*websocket.Conn) {})
+
+	test("disconnect", func(ws *TestServer) {
+		ws.m.HandleDisconnect(func(*Session) { panic("disconnect") })
+	}, func(conn *websocket.Conn) {
+		conn.Close()
+	})
+
+	test("pong", func(ws *TestServer) {
+		ws.m.HandlePong(func(*Session) { panic("pong") })
+	}, func(conn *websocket.Conn) {
+		go conn.NextReader()
+	})
+
+	test("close", func(ws *TestServer) {
+		ws.m.HandleClose(func(*Session, int, string) error { panic("close") })
+	}, func(conn *websocket.Conn) {
+		conn.WriteMessage(websocket.CloseMessage, nil)
+	})
+}
+
+func TestPanicError(t *testing.T) {
+	errs := make(chan error, 1)
+
+	ws := NewTestServerHandler(func(*Session, []byte) {
+		panic("oops")
+	})
+	ws.m.Config.CloseOnPanic = true
+	ws.m.HandleError(func(s *Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, TestMsg)
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseInternalServerErr))
+
+	var panicErr *PanicError
+	assert.ErrorAs(t, <-errs, &panicErr)
+	assert.Equal(t, "oops", panicErr.Value)
+	assert.NotEmpty(t, panicErr.Stack)
+}
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+			s.Write(msg)
+		})
+		ws.m.Config.WorkerPoolSize = 4
+		ws.m.Config.PreserveMessageOrder = true
+		ws.m.Config.MaxInFlight = 8
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		n := 20
+		go func() {
+			for i := 0; i < n; i++ {
+				conn.WriteMessage(websocket.TextMessage, []byte(strconv.Itoa(i)))
+			}
+		}()
+
+		for i := 0; i < n; i++ {
+			_, ret, err := conn.ReadMessage()
+			assert.Nil(t, err)
+			assert.Equal(t, strconv.Itoa(i), string(ret))
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		var running, peak atomic.Int32
+		var wg sync.WaitGroup
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			wg.Done()
+		})
+		ws.m.Config.WorkerPoolSize = 2
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		for i := 0; i < 3; i++ {
+			conn := MustNewDialer(server.URL)
+			defer conn.Close()
+
+			for j := 0; j < 4; j++ {
+				wg.Add(1)
+				conn.WriteMessage(websocket.TextMessage, TestMsg)
+			}
+		}
+
+		wg.Wait()
+		assert.Equal(t, int32(2), peak.Load())
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		release := make(chan bool)
+		errs := make(chan error, 1)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			<-release
+		})
+		ws.m.Config.WorkerPoolSize = 2
+		ws.m.Config.MaxInFlight = 1
+		ws.m.Config.ShedWhenSaturated = true
+		ws.m.HandleError(func(s *Session, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+
+		assert.ErrorIs(t, <-errs, ErrWorkerPoolFull)
+		close(release)
+	})
+
+	t.Run("ordered shed", func(t *testing.T) {
+		release := make(chan bool)
+		errs := make(chan error, 1)
+		sessions := make(chan *Session, 1)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			<-release
+		})
+		ws.m.Config.WorkerPoolSize = 1
+		ws.m.Config.WorkerQueueSize = 2
+		ws.m.Config.PreserveMessageOrder = true
+		ws.m.Config.ShedWhenSaturated = true
+		ws.m.HandleConnect(func(s *Session) {
+			sessions <- s
+		})
+		ws.m.HandleError(func(s *Session, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		s := <-sessions
+
+		for i := 0; i < 10; i++ {
+			conn.WriteMessage(websocket.TextMessage, TestMsg)
+		}
+
+		assert.ErrorIs(t, <-errs, ErrWorkerPoolFull)
+
+		s.queueMu.Lock()
+		assert.LessOrEqual(t, len(s.queue), 2)
+		s.queueMu.Unlock()
+
+		close(release)
+	})
+}
+
+func TestAuthenticator(t *testing.T) {
+	type user struct {
+		Name string
+	}
+
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		u, ok := PrincipalAs[user](s)
+		assert.True(t, ok)
+		s.Write([]byte(u.Name))
+	})
+
+	ws.m.Authenticator = AuthenticatorFunc(func(r *http.Request) (any, error) {
+		switch r.URL.Query().Get("token") {
+		case "":
+			return nil, errors.New("no token")
+		case "secret":
+			return user{Name: "gopher"}, nil
+		}
+		return nil, &AuthError{Status: http.StatusForbidden}
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{}
+	url := strings.Replace(server.URL, "http", "ws", 1)
+
+	_, res, err := dialer.Dial(url, nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	_, res, err = dialer.Dial(url+"?token=wrong", nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	conn := MustNewDialer(server.URL + "?token=secret")
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, TestMsg)
+
+	_, ret, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "gopher", string(ret))
+}
+
+func TestMessageAuthenticator(t *testing.T) {
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+	ws.m.Config.AuthTimeout = 50 * time.Millisecond
+
+	ws.m.MessageAuthenticator = MessageAuthenticatorFunc(func(s *Session, msg []byte) (any, error) {
+		if string(msg) == "secret" {
+			return "gopher", nil
+		}
+		return nil, ErrUnauthenticated
+	})
+
+	ws.m.HandleConnect(func(s *Session) {
+		s.Write([]byte(s.Principal().(string)))
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("secret"))
+	conn.WriteMessage(websocket.TextMessage, TestMsg)
+
+	for _, want := range []string{"gopher", string(TestMsg)} {
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(ret))
+	}
+
+	conn = MustNewDialer(server.URL)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("wrong"))
+
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, ClosePolicyViolation))
+
+	conn = MustNewDialer(server.URL)
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, ClosePolicyViolation))
+}
+
+func TestCredentialExpiry(t *testing.T) {
+	t.Run("expire", func(t *testing.T) {
+		expiring := make(chan time.Time, 1)
+		errs := make(chan error, 1)
+
+		ws := NewTestServer()
+		ws.m.Config.CredentialRefreshWindow = 50 * time.Millisecond
+
+		ws.m.HandleConnect(func(s *Session) {
+			s.SetCredentialExpiry(time.Now().Add(100 * time.Millisecond))
+		})
+
+		ws.m.HandleCredentialExpiring(func(s *Session, expiry time.Time) {
+			assert.Equal(t, s.CredentialExpiry(), expiry)
+			expiring <- expiry
+		})
+
+		ws.m.HandleError(func(s *Session, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, ClosePolicyViolation))
+		assert.Len(t, expiring, 1)
+		assert.ErrorIs(t, <-errs, ErrCredentialExpired)
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		refreshed := make(chan bool)
+
+		ws := NewTestServerHandler(func(s *Session, msg []byte) {
+			s.Write(msg)
+		})
+		ws.m.Config.CredentialRefreshWindow = 50 * time.Millisecond
+
+		ws.m.HandleConnect(func(s *Session) {
+			s.SetCredentialExpiry(time.Now().Add(60 * time.Millisecond))
+		})
+
+		ws.m.HandleCredentialExpiring(func(s *Session, expiry time.Time) {
+			if s.Principal() == nil {
+				s.Reauthenticate("refreshed", time.Now().Add(time.Hour))
+				close(refreshed)
+			}
+		})
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+
+		conn := MustNewDialer(server.URL)
+		defer conn.Close()
+
+		<-refreshed
+		time.Sleep(100 * time.Millisecond)
+
+		conn.WriteMessage(websocket.TextMessage, TestMsg)
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, TestMsg, ret)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	ss := make(chan *Session)
+	metrics := NewMetricsCollector()
+
+	ws := NewTestServer()
+	ws.m.Config.EnableCompression = true
+	ws.m.Config.CompressionLevel = 9
+	ws.m.Config.CompressionThreshold = 100
+	ws.m.Config.Metrics = metrics
+
+	ws.m.HandleConnect(func(s *Session) {
+		ss <- s
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, res, err := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	assert.Nil(t, err)
+	assert.Contains(t, res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	defer conn.Close()
+
+	s := <-ss
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 100)
+
+	assert.Nil(t, s.Write(small))
+	assert.Nil(t, s.Write(large))
+	assert.Nil(t, ws.m.BroadcastCompressed(small, true))
+	assert.Nil(t, ws.m.BroadcastBinaryCompressed(large, false))
+
+	for _, want := range [][]byte{small, large, small, large} {
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, want, ret)
+	}
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+
+	assert.Contains(t, buf.String(), "melody_compression_input_bytes_total 505\n")
+	assert.Regexp(t, "melody_compression_output_bytes_total [1-9][0-9]?\n", buf.String())
+
+	plain := MustNewDialer(server.URL)
+	defer plain.Close()
+
+	s = <-ss
+
+	assert.Nil(t, s.Write(large))
+
+	_, ret, err := plain.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, large, ret)
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (discardConn) Close() error                     { return nil }
+func (discardConn) SetDeadline(time.Time) error      { return nil }
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+func (discardConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c := discardConn{}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+func benchmarkSessions(b *testing.B, n int, compress bool) []*Session {
+	m := New()
+	m.Config.EnableCompression = compress
+	upgrader := m.upgrader()
+
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-Websocket-Version", "13")
+		r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if compress {
+			r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+		}
+
+		conn, err := upgrader.Upgrade(hijackRecorder{httptest.NewRecorder()}, r, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		sessions[i] = &Session{
+			conn:       conn,
+			melody:     m,
+			open:       true,
+			compressed: negotiatesCompression(upgrader, r),
+		}
+	}
+
+	return sessions
+}
+
+func benchmarkBroadcast(b *testing.B, compress, prepare bool) {
+	sessions := benchmarkSessions(b, 10000, compress)
+	msg := bytes.Repeat([]byte("melody "), 128)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		message := envelope{t: websocket.TextMessage, msg: msg}
+		if prepare {
+			message.prepared = &prepared{}
+		}
+
+		for _, s := range sessions {
+			if err := s.writeRaw(message); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBroadcast10k(b *testing.B) {
+	b.Run("Plain", func(b *testing.B) { benchmarkBroadcast(b, false, false) })
+	b.Run("Prepared", func(b *testing.B) { benchmarkBroadcast(b, false, true) })
+	b.Run("PlainCompressed", func(b *testing.B) { benchmarkBroadcast(b, true, false) })
+	b.Run("PreparedCompressed", func(b *testing.B) { benchmarkBroadcast(b, true, true) })
+}
+
+func TestResume(t *testing.T) {
+	connected := make(chan *Session, 2)
+	resumed := make(chan *Session, 1)
+	disconnected := make(chan *Session, 2)
+
+	ws := NewTestServer()
+	ws.m.Config.ResumeWindow = time.Minute
+	ws.m.Config.ResumeBufferSize = 3
+
+	ws.m.HandleConnect(func(s *Session) {
+		s.Set("user", "gopher")
+		s.Join("room")
+		connected <- s
+	})
+
+	ws.m.HandleResume(func(s *Session) {
+		resumed <- s
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	hello := func(conn *websocket.Conn) ResumeInfo {
+		var f struct {
+			Type string
+			Data ResumeInfo
+		}
+		assert.Nil(t, conn.ReadJSON(&f))
+		assert.Equal(t, ResumeEvent, f.Type)
+		return f.Data
+	}
+
+	conn := MustNewDialer(server.URL)
+	info := hello(conn)
+	assert.Equal(t, uint64(0), info.Seq)
+	assert.NotEmpty(t, info.Token)
+
+	s := <-connected
+
+	ws.m.Broadcast([]byte("one"))
+	ws.m.Broadcast([]byte("two"))
+
+	for _, want := range []string{"one", "two"} {
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(ret))
+	}
+
+	conn.Close()
+	<-disconnected
+
+	ws.m.BroadcastRoom("room", []byte("three"))
+	ws.m.BroadcastRoom("other", []byte("ignored"))
+	ws.m.Broadcast([]byte("four"))
+
+	assert.Equal(t, 0, ws.m.Len())
+
+	rooms, err := ws.m.Rooms()
+	assert.Nil(t, err)
+	assert.Empty(t, rooms)
+
+	stale := MustNewDialer(server.URL + "?resume=" + info.Token + "&seq=0")
+	assert.NotEqual(t, info.Token, hello(stale).Token)
+	fresh := <-connected
+	assert.NotEqual(t, s.ID(), fresh.ID())
+	stale.Close()
+	<-disconnected
+
+	conn = MustNewDialer(server.URL + "?resume=" + info.Token + "&seq=1")
+	defer conn.Close()
+
+	assert.Equal(t, ResumeInfo{Token: info.Token, Seq: 1}, hello(conn))
+
+	for _, want := range []string{"two", "three", "four"} {
+		_, ret, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(ret))
+	}
+
+	r := <-resumed
+	assert.Equal(t, s.ID(), r.ID())
+	assert.Equal(t, "gopher", r.MustGet("user"))
+	assert.Equal(t, []string{"room"}, r.Rooms())
+
+	ws.m.BroadcastRoom("room", []byte("five"))
+
+	_, ret, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "five", string(ret))
+}
+
+func TestResumeConnected(t *testing.T) {
+	resumed := make(chan *Session, 1)
+	reasons := make(chan CloseReason, 1)
+
+	ws := NewTestServer()
+	ws.m.Config.ResumeWindow = time.Minute
+
+	ws.m.HandleResume(func(s *Session) {
+		resumed <- s
+	})
+
+	ws.m.HandleDisconnectWithReason(func(s *Session, reason CloseReason) {
+		reasons <- reason
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	hello := func(conn *websocket.Conn) ResumeInfo {
+		var f struct{ Data ResumeInfo }
+		assert.Nil(t, conn.ReadJSON(&f))
+		return f.Data
+	}
+
+	old := MustNewDialer(server.URL)
+	defer old.Close()
+	info := hello(old)
+
+	ws.m.Broadcast([]byte("one"))
+	ws.m.Broadcast([]byte("two"))
+
+	_, ret, err := old.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "one", string(ret))
+
+	// The client reconnects while its old connection is still open.
+	conn := MustNewDialer(server.URL + "?resume=" + info.Token + "&seq=1")
+	defer conn.Close()
+
+	assert.Equal(t, ResumeInfo{Token: info.Token, Seq: 1}, hello(conn))
+
+	_, ret, err = conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "two", string(ret))
+
+	reason := <-reasons
+	assert.Equal(t, InitiatorServer, reason.Initiator)
+	assert.ErrorIs(t, reason.Err, ErrSessionResumed)
+
+	for err == nil {
+		_, _, err = old.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, CloseGoingAway))
+
+	<-resumed
+	assert.Equal(t, 1, ws.m.Len())
+
+	ws.m.Broadcast([]byte("three"))
+
+	_, ret, err = conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, "three", string(ret))
+}
+
+func TestResumeDuringBroadcast(t *testing.T) {
+	m := New()
+	m.Config.ResumeWindow = time.Minute
+
+	old := m.newSession(httptest.NewRequest("GET", "/", nil), nil, newChanConn(), nil)
+	old.resume = newResumption(old)
+	old.close()
+	old.retainBuffered()
+	m.park(old)
+
+	s := m.newSession(httptest.NewRequest("GET", "/", nil), nil, newChanConn(), nil)
+	_, ok := m.hub.resume(old.resume.token, s, 0)
+	assert.True(t, ok)
+
+	// A broadcast picked the parked session before it was resumed.
+	deliver(envelope{t: websocket.TextMessage, msg: TestMsg}, nil, []*Session{old})
+
+	select {
+	case message := <-s.output:
+		assert.Equal(t, TestMsg, message.msg)
+	default:
+		t.Fatal("message was not written to the resumed session")
+	}
+}
+
+func TestResumeBufferedOrder(t *testing.T) {
+	m := New()
+	m.Config.ResumeWindow = time.Minute
+
+	s := m.newSession(httptest.NewRequest("GET", "/", nil), nil, newChanConn(), nil)
+	s.resume = newResumption(s)
+
+	s.Write([]byte("1"))
+	s.Write([]byte("2"))
+	s.close()
+
+	// Written after the session closed but before its buffer was recorded.
+	s.writeMessage(envelope{t: websocket.TextMessage, msg: []byte("3")})
+
+	s.retainBuffered()
+	s.writeMessage(envelope{t: websocket.TextMessage, msg: []byte("4")})
+
+	replay, ok := s.resume.since(0)
+	assert.True(t, ok)
+
+	var got []string
+	for _, message := range replay {
+		got = append(got, string(message.msg))
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4"}, got)
+}
+
+func TestPresence(t *testing.T) {
+	sessions := make(chan *Session, 1)
+	disconnected := make(chan struct{}, 1)
+	events := make(chan PresenceEvent, 16)
+
+	ws := NewTestServer()
+	ws.m.Config.PresenceKey = "user"
+	ws.m.Config.PresenceDebounce = 200 * time.Millisecond
+	ws.m.Config.PresenceBroadcast = true
+
+	ws.m.HandleConnect(func(s *Session) {
+		s.Set("user", s.Request.URL.Query().Get("user"))
+		s.Join("room")
+		sessions <- s
+	})
+
+	ws.m.HandleDisconnect(func(s *Session) {
+		disconnected <- struct{}{}
+	})
+
+	ws.m.HandlePresence(func(e PresenceEvent) {
+		events <- e
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	expect := func(want ...PresenceEvent) {
+		got := make([]PresenceEvent, len(want))
+		for i := range got {
+			got[i] = <-events
+		}
+		assert.ElementsMatch(t, want, got)
+		assert.Len(t, events, 0)
+	}
+
+	alice1 := MustNewDialer(server.URL + "?user=alice")
+	s := <-sessions
+	expect(
+		PresenceEvent{Kind: PresenceJoin, Room: "room", PresenceInfo: PresenceInfo{User: "alice"}},
+		PresenceEvent{Kind: PresenceJoin, Room: "", PresenceInfo: PresenceInfo{User: "alice"}},
+	)
+
+	alice2 := MustNewDialer(server.URL + "?user=alice")
+	<-sessions
+
+	bob := MustNewDialer(server.URL + "?user=bob")
+	defer bob.Close()
+	<-sessions
+	expect(
+		PresenceEvent{Kind: PresenceJoin, Room: "room", PresenceInfo: PresenceInfo{User: "bob"}},
+		PresenceEvent{Kind: PresenceJoin, Room: "", PresenceInfo: PresenceInfo{User: "bob"}},
+	)
+
+	assert.Nil(t, ws.m.Presence().Update(s, "away"))
+	expect(
+		PresenceEvent{Kind: PresenceUpdate, Room: "room", PresenceInfo: PresenceInfo{User: "alice", Meta: "away"}},
+		PresenceEvent{Kind: PresenceUpdate, Room: "", PresenceInfo: PresenceInfo{User: "alice", Meta: "away"}},
+	)
+
+	assert.Equal(t, []PresenceInfo{{User: "alice", Meta: "away"}, {User: "bob"}}, ws.m.Presence().List("room"))
+
+	alice1.Close()
+	<-disconnected
+	alice2.Close()
+	<-disconnected
+
+	alice3 := MustNewDialer(server.URL + "?user=alice")
+	<-sessions
+	assert.Len(t, events, 0)
+	assert.Equal(t, []PresenceInfo{{User: "alice", Meta: "away"}, {User: "bob"}}, ws.m.Presence().List(""))
+
+	alice3.Close()
+	<-disconnected
+
+	expect(
+		PresenceEvent{Kind: PresenceLeave, Room: "room", PresenceInfo: PresenceInfo{User: "alice", Meta: "away"}},
+		PresenceEvent{Kind: PresenceLeave, Room: "", PresenceInfo: PresenceInfo{User: "alice", Meta: "away"}},
+	)
+
+	assert.Equal(t, []PresenceInfo{{User: "bob"}}, ws.m.Presence().List("room"))
+
+	leaves := 0
+	for leaves < 2 {
+		var f struct {
+			Type string
+			Data PresenceEvent
+		}
+		assert.Nil(t, bob.ReadJSON(&f))
+		assert.Equal(t, PresenceEventName, f.Type)
+		if f.Data.Kind == PresenceLeave {
+			assert.Equal(t, "alice", f.Data.User)
+			leaves++
+		}
+	}
+
+	assert.ErrorIs(t, ws.m.Presence().Update(&Session{}, nil), ErrNotTracked)
+}
+
+func TestTransport(t *testing.T) {
+	disconnected := make(chan *Session, 1)
+
+	m := New()
+	m.HandleMessage(func(s *Session, msg []byte) {
+		s.Write(msg)
+	})
+	m.HandleMessageBinary(func(s *Session, msg []byte) {
+		s.WriteBinary(msg)
+	})
+	m.HandleDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleTransport(w, r)
+	}))
+	defer server.Close()
+
+	post := func(sid, contentType, body string) {
+		res, err := http.Post(server.URL+"?sid="+sid, contentType, strings.NewReader(body))
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	}
+
+	hangup := func(sid string) {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"?sid="+sid, nil)
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+	}
+
+	t.Run("sse", func(t *testing.T) {
+		res, err := http.Get(server.URL + "?transport=sse")
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+		events := bufio.NewReader(res.Body)
+		event := func() string {
+			var lines []string
+			for {
+				line, err := events.ReadString('\n')
+				assert.Nil(t, err)
+				if line == "\n" {
+					return strings.Join(lines, "")
+				}
+				lines = append(lines, line)
+			}
+		}
+
+		open := event()
+		assert.True(t, strings.HasPrefix(open, "event: open\ndata: "))
+		sid := strings.TrimSpace(strings.TrimPrefix(open, "event: open\ndata: "))
+
+		post(sid, "text/plain", "hello\nworld")
+		assert.Equal(t, "data: hello\ndata: world\n", event())
+
+		post(sid, "text/plain", "hi\revent: close\r\nbye")
+		assert.Equal(t, "data: hi\ndata: event: close\ndata: bye\n", event())
+
+		post(sid, "application/octet-stream", "bin")
+		assert.Equal(t, "event: binary\ndata: Ymlu\n", event())
+
+		m.Broadcast([]byte("all"))
+		assert.Equal(t, "data: all\n", event())
+
+		hangup(sid)
+		s := <-disconnected
+		assert.Nil(t, s.WebsocketConnection())
+	})
+
+	t.Run("poll", func(t *testing.T) {
+		res, err := http.Get(server.URL + "?transport=poll")
+		assert.Nil(t, err)
+		var open struct{ SID string }
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&open))
+		res.Body.Close()
+		assert.NotEmpty(t, open.SID)
+
+		poll := func() []TransportFrame {
+			res, err := http.Get(server.URL + "?sid=" + open.SID)
+			assert.Nil(t, err)
+			defer res.Body.Close()
+			var frames []TransportFrame
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(&frames))
+			return frames
+		}
+
+		post(open.SID, "text/plain", "hello")
+		assert.Equal(t, []TransportFrame{{Type: "text", Data: "hello"}}, poll())
+
+		m.BroadcastBinary([]byte("bin"))
+		assert.Equal(t, []TransportFrame{{Type: "binary", Data: "Ymlu"}}, poll())
+
+		s := m.hub.all()[0]
+		s.CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "bye"))
+		assert.Equal(t, []TransportFrame{{Type: "close", Data: "bye", Code: CloseNormalClosure}}, poll())
+		<-disconnected
+
+		res, err = http.Get(server.URL + "?sid=" + open.SID)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		res, err := http.Get(server.URL + "?transport=poll")
+		assert.Nil(t, err)
+		var open struct{ SID string }
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&open))
+		res.Body.Close()
+
+		for m.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		assert.Nil(t, m.Shutdown(context.Background()))
+		<-disconnected
+
+		res, err = http.Get(server.URL + "?sid=" + open.SID)
+		assert.Nil(t, err)
+		var frames []TransportFrame
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&frames))
+		res.Body.Close()
+		assert.Equal(t, []TransportFrame{{Type: "close", Code: CloseServiceRestart}}, frames)
+
+		res, err = http.Get(server.URL + "?transport=poll")
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	})
+}
+
+type chanConn struct {
+	in     chan []byte
+	out    chan []byte
+	done   chan struct{}
+	closed sync.Once
+}
+
+func newChanConn() *chanConn {
+	return &chanConn{in: make(chan []byte), out: make(chan []byte, 16), done: make(chan struct{})}
+}
+
+func (c *chanConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-c.in:
+		return TextMessage, msg, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *chanConn) WriteMessage(t int, data []byte) error {
+	if t == TextMessage {
+		c.out <- data
+	}
+	return nil
+}
+
+func (c *chanConn) WriteControl(int, []byte, time.Time) error { return nil }
+func (c *chanConn) SetReadLimit(int64)                        {}
+func (c *chanConn) SetReadDeadline(time.Time) error           { return nil }
+func (c *chanConn) SetWriteDeadline(time.Time) error          { return nil }
+func (c *chanConn) SetPongHandler(func(string) error)         {}
+func (c *chanConn) SetCloseHandler(func(int, string) error)   {}
+func (c *chanConn) LocalAddr() net.Addr                       { return nil }
+func (c *chanConn) RemoteAddr() net.Addr                      { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func (c *chanConn) Close() error {
+	c.closed.Do(func() { close(c.done) })
+	return nil
+}
+
+func TestHandleConn(t *testing.T) {
+	ws := NewTestServerHandler(func(s *Session, msg []byte) {
+		s.Write(append([]byte(s.MustGet("prefix").(string)), msg...))
+	})
+
+	conn := newChanConn()
+	done := make(chan error)
+
+	go func() {
+		done <- ws.m.HandleConn(conn, nil, map[string]any{"prefix": "echo: "})
+	}()
+
+	conn.in <- TestMsg
+	assert.Equal(t, "echo: test", string(<-conn.out))
+
+	ws.m.Broadcast(TestMsg)
+	assert.Equal(t, TestMsg, <-conn.out)
+
+	s := ws.m.hub.all()[0]
+	assert.Equal(t, conn, s.Conn())
+	assert.Nil(t, s.WebsocketConnection())
+	assert.Equal(t, "127.0.0.1:0", s.Request.RemoteAddr)
+
+	conn.Close()
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, ws.m.Len())
+
+	ws.m.Authenticator = AuthenticatorFunc(func(r *http.Request) (any, error) {
+		return nil, errors.New("denied")
+	})
+	assert.EqualError(t, ws.m.HandleConn(newChanConn(), nil, nil), "denied")
+}
+
+func TestDisconnectReason(t *testing.T) {
+	sessions := make(chan *Session)
+	reasons := make(chan CloseReason)
+
+	ws := NewTestServer()
+	ws.m.Config.MaxMessageSize = 8
+
+	ws.m.HandleConnect(func(s *Session) {
+		assert.Equal(t, CloseReason{}, s.CloseReason())
+		sessions <- s
+	})
+
+	ws.m.HandleDisconnectWithReason(func(s *Session, reason CloseReason) {
+		assert.Equal(t, reason, s.CloseReason())
+		reasons <- reason
+	})
+
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn := MustNewDialer(server.URL)
+	<-sessions
+	conn.WriteMessage(websocket.CloseMessage, FormatCloseMessage(CloseGoingAway, "bye"))
+	assert.Equal(t, CloseReason{Initiator: InitiatorClient, Code: CloseGoingAway, Text: "bye"}, <-reasons)
+	conn.Close()
+
+	conn = MustNewDialer(server.URL)
+	(<-sessions).CloseWithMsg(FormatCloseMessage(CloseNormalClosure, "done"))
+	assert.Equal(t, CloseReason{Initiator: InitiatorServer, Code: CloseNormalClosure, Text: "done"}, <-reasons)
+	conn.Close()
+
+	conn = MustNewDialer(server.URL)
+	<-sessions
+	conn.WriteMessage(websocket.TextMessage, []byte("too long message"))
+	reason := <-reasons
+	assert.Equal(t, InitiatorServer, reason.Initiator)
+	assert.Equal(t, CloseMessageTooBig, reason.Code)
+	assert.ErrorIs(t, reason.Err, websocket.ErrReadLimit)
+	conn.Close()
+
+	conn = MustNewDialer(server.URL)
+	<-sessions
+	conn.UnderlyingConn().Close()
+	reason = <-reasons
+	assert.Equal(t, InitiatorNetwork, reason.Initiator)
+	assert.Equal(t, CloseAbnormalClosure, reason.Code)
+	assert.NotNil(t, reason.Err)
+
+	conn = MustNewDialer(server.URL)
+	defer conn.Close()
+	<-sessions
+	ws.m.Close()
+	reason = <-reasons
+	assert.Equal(t, InitiatorServer, reason.Initiator)
+	assert.ErrorIs(t, reason.Err, ErrClosed)
+}
+
+func TestOverflowBlockDoesNotHoldHub(t *testing.T) {
+	ws := NewTestServer()
+	ws.m.Config.MessageBufferSize = 1
+	ws.m.Config.OverflowPolicy = OverflowBlock
+	ws.m.Config.OverflowTimeout = time.Minute
+
+	slow := newChanConn()
+	go ws.m.HandleConn(slow, nil, nil)
+
+	for ws.m.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for i := 0; i < cap(slow.out)+3; i++ {
+			ws.m.Broadcast(TestMsg)
+		}
+	}()
+
+	for len(slow.out) < cap(slow.out) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	other := newChanConn()
+	go ws.m.HandleConn(other, nil, nil)
+
+	registered := make(chan struct{})
+	go func() {
+		for ws.m.Len() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(registered)
+	}()
+
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("blocked broadcast held up the hub")
+	}
+
+	select {
+	case <-broadcasting:
+		t.Fatal("broadcast did not block on the full session")
+	default:
+	}
+
+	slow.Close()
+	other.Close()
+	<-broadcasting
+}
+
+func TestPresenceJoinAfterDisconnect(t *testing.T) {
+	disconnected := make(chan *Session)
+
+	ws := NewTestServer()
+	ws.m.Config.PresenceKey = "user"
+	ws.m.HandleDisconnect(func(s *Session) {
+		disconnected <- s
+	})
+
+	conn := newChanConn()
+	go ws.m.HandleConn(conn, nil, map[string]any{"user": "gopher"})
+
+	for ws.m.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Len(t, ws.m.Presence().List(""), 1)
+
+	conn.Close()
+	s := <-disconnected
+
+	// A join racing the disconnect reaches presence after the session was untracked.
+	ws.m.presence.join(s, "room")
+
+	assert.Empty(t, ws.m.Presence().List(""))
+	assert.Empty(t, ws.m.Presence().List("room"))
+}
+
+func TestPresenceLocal(t *testing.T) {
+	emitted := make(chan PresenceEvent, 2)
+	backplane := NewMemoryBackplane()
+
+	nodes := []*TestServer{NewTestServer(), NewTestServer()}
+	urls := make([]string, len(nodes))
+
+	for i, ws := range nodes {
+		ws.m.Config.PresenceKey = "user"
+		ws.m.Config.PresenceBroadcast = true
+		ws.m.HandleConnect(func(s *Session) {
+			s.Set("user", s.Request.URL.Query().Get("user"))
+			s.Join("room")
+		})
+		assert.Nil(t, ws.m.SetBackplane(backplane))
+
+		server := httptest.NewServer(ws)
+		defer server.Close()
+		urls[i] = server.URL
+	}
+
+	nodes[0].m.HandlePresence(func(e PresenceEvent) {
+		emitted <- e
+	})
+
+	bob := MustNewDialer(urls[1] + "?user=bob")
+	defer bob.Close()
+
+	for i := 0; i < 2; i++ {
+		var f struct{ Data PresenceEvent }
+		assert.Nil(t, bob.ReadJSON(&f))
+		assert.Equal(t, "bob", f.Data.User)
+	}
+
+	alice := MustNewDialer(urls[0] + "?user=alice")
+	defer alice.Close()
+	<-emitted
+	<-emitted
+
+	assert.Nil(t, nodes[1].m.BroadcastRoom("room", TestMsg))
+
+	_, ret, err := bob.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, TestMsg, ret)
+}
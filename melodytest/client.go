@@ -0,0 +1,267 @@
+// Package melodytest tests melody applications without a network. A Client
+// connects to a melody.Melody over an in-memory pipe, and a Clock controls
+// time for pings, pongs, deadlines and other timeouts.
+//
+//	m := melody.New()
+//	m.HandleMessage(func(s *melody.Session, msg []byte) {
+//		m.Broadcast(msg)
+//	})
+//
+//	c := melodytest.Dial(m)
+//	defer c.Close(melody.CloseNormalClosure, "")
+//
+//	c.Send([]byte("hello"))
+//	c.Expect(t, []byte("hello"))
+package melodytest
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+// ErrTimeout is returned by a Client that waited longer than Dialer.Timeout.
+var ErrTimeout = errors.New("melodytest: timed out")
+
+// Dialer connects clients to a melody instance.
+type Dialer struct {
+	Request    *http.Request  // Request of the session, see melody.HandleConn.
+	Keys       map[string]any // Keys of the session.
+	BufferSize int            // Messages the client buffers before writes to it block, defaults to 256.
+	Timeout    time.Duration  // How long the client waits for the session, defaults to one second.
+}
+
+// Dial connects a client to m with the default Dialer.
+func Dial(m *melody.Melody) *Client {
+	return (&Dialer{}).Dial(m)
+}
+
+// Dial connects a client to m. The session is served by melody.HandleConn in its
+// own goroutine using m.Config.Clock for deadlines.
+func (d *Dialer) Dial(m *melody.Melody) *Client {
+	size := d.BufferSize
+	if size <= 0 {
+		size = 256
+	}
+
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	c := &Client{
+		conn:    newConn(m.Config.Clock, size),
+		melody:  m,
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		c.err = m.HandleConn(c.conn, d.Request, d.Keys)
+		close(c.done)
+	}()
+
+	return c
+}
+
+// Client is a fake websocket client connected over an in-memory pipe. Messages
+// written to the session are buffered until the client receives them, a client
+// that does not call Receive long enough is a slow reader. Pings are answered
+// unless IgnorePings is set.
+type Client struct {
+	conn    *conn
+	melody  *melody.Melody
+	timeout time.Duration
+	done    chan struct{}
+	err     error
+}
+
+// Session returns the session of the client, waiting for it to connect. It
+// returns nil if the session did not connect in time.
+func (c *Client) Session() *melody.Session {
+	deadline := time.Now().Add(c.timeout)
+
+	for {
+		sessions, _ := c.melody.Sessions()
+		for _, s := range sessions {
+			if s.Conn() == melody.Conn(c.conn) {
+				return s
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Send writes a text message to the session.
+func (c *Client) Send(msg []byte) error {
+	return c.send(frame{t: websocket.TextMessage, data: msg})
+}
+
+// SendBinary writes a binary message to the session.
+func (c *Client) SendBinary(msg []byte) error {
+	return c.send(frame{t: websocket.BinaryMessage, data: msg})
+}
+
+func (c *Client) send(f frame) error {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case c.conn.fromClient <- f:
+		return nil
+	case <-c.conn.closed:
+		return websocket.ErrCloseSent
+	case <-c.conn.dropped:
+		return websocket.ErrCloseSent
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Receive returns the next message written to the client. A close message is
+// returned as a *websocket.CloseError, as is a session that closed without one.
+func (c *Client) Receive() (messageType int, msg []byte, err error) {
+	select {
+	case f := <-c.conn.toClient:
+		return c.received(f)
+	default:
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case f := <-c.conn.toClient:
+		return c.received(f)
+	case <-c.conn.closed:
+		select {
+		case f := <-c.conn.toClient:
+			return c.received(f)
+		default:
+			return 0, nil, &websocket.CloseError{Code: websocket.CloseAbnormalClosure}
+		}
+	case <-timer.C:
+		return 0, nil, ErrTimeout
+	}
+}
+
+func (c *Client) received(f frame) (int, []byte, error) {
+	if f.t != websocket.CloseMessage {
+		return f.t, f.data, nil
+	}
+
+	closeErr := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+	if len(f.data) >= 2 {
+		closeErr.Code = int(f.data[0])<<8 | int(f.data[1])
+		closeErr.Text = string(f.data[2:])
+	}
+
+	return 0, nil, closeErr
+}
+
+// Close writes a close message with code and text to the session.
+func (c *Client) Close(code int, text string) error {
+	return c.send(frame{t: websocket.CloseMessage, data: melody.FormatCloseMessage(code, text)})
+}
+
+// Drop disconnects the client abruptly, without a close message.
+func (c *Client) Drop() {
+	c.conn.drop()
+}
+
+// IgnorePings stops the client from answering pings, so that the session times
+// out once the clock passes melody.Config.PongWait.
+func (c *Client) IgnorePings(ignore bool) {
+	c.conn.ignore.Store(ignore)
+}
+
+// Done is closed once the session has disconnected.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error melody.HandleConn returned once the session has disconnected.
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Expect asserts that the next message is the text message want.
+func (c *Client) Expect(t testing.TB, want []byte) {
+	t.Helper()
+	c.expect(t, websocket.TextMessage, want)
+}
+
+// ExpectBinary asserts that the next message is the binary message want.
+func (c *Client) ExpectBinary(t testing.TB, want []byte) {
+	t.Helper()
+	c.expect(t, websocket.BinaryMessage, want)
+}
+
+func (c *Client) expect(t testing.TB, messageType int, want []byte) {
+	t.Helper()
+
+	got, msg, err := c.Receive()
+
+	if err != nil {
+		t.Fatalf("melodytest: expected message %q: %v", want, err)
+	}
+
+	if got != messageType || !bytes.Equal(msg, want) {
+		t.Errorf("melodytest: expected message %q of type %d, got %q of type %d", want, messageType, msg, got)
+	}
+}
+
+// ExpectNothing asserts that no message is written to the client within d.
+func (c *Client) ExpectNothing(t testing.TB, d time.Duration) {
+	t.Helper()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case f := <-c.conn.toClient:
+		t.Errorf("melodytest: expected no message, got %q of type %d", f.data, f.t)
+	case <-timer.C:
+	}
+}
+
+// ExpectClose asserts that the next message is a close message with code.
+func (c *Client) ExpectClose(t testing.TB, code int) {
+	t.Helper()
+
+	_, msg, err := c.Receive()
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("melodytest: expected close %d, got message %q, %v", code, msg, err)
+	}
+
+	if closeErr.Code != code {
+		t.Errorf("melodytest: expected close %d, got %d %q", code, closeErr.Code, closeErr.Text)
+	}
+}
+
+// ExpectDisconnect asserts that the session disconnects within the timeout of the Dialer.
+func (c *Client) ExpectDisconnect(t testing.TB) {
+	t.Helper()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+	case <-timer.C:
+		t.Fatalf("melodytest: expected session to disconnect")
+	}
+}
@@ -0,0 +1,186 @@
+package melodytest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+// Clock is a melody.Clock whose time only moves when it is advanced. Set it as
+// melody.Config.Clock before dialing to test pings, pongs, deadlines and other
+// timeouts without sleeping.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+var _ melody.Clock = (*Clock)(nil)
+
+// NewClock returns a clock set to the current time. Deadlines of real network
+// connections are wall clock times, starting from now keeps them from expiring
+// while the clock is advanced.
+func NewClock() *Clock {
+	return &Clock{now: time.Now()}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers that are
+// due in order. It returns once the functions of the AfterFunc timers that were
+// due have returned.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+
+	var funcs []func()
+
+	for {
+		t := c.next(end)
+		if t == nil {
+			break
+		}
+
+		c.now = t.when
+		if t.f != nil {
+			funcs = append(funcs, t.f)
+		} else {
+			t.fire()
+		}
+	}
+
+	c.now = end
+	c.mu.Unlock()
+
+	for _, f := range funcs {
+		f()
+	}
+}
+
+// next returns the earliest timer due at or before end, c.mu must be held.
+func (c *Clock) next(end time.Time) *timer {
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		return nil
+	}
+
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+
+	return t
+}
+
+// NewTimer returns a timer firing once the clock has advanced by d.
+func (c *Clock) NewTimer(d time.Duration) melody.Timer {
+	return c.add(&timer{c: make(chan time.Time, 1)}, d)
+}
+
+// NewTicker returns a ticker firing every time the clock has advanced by d.
+func (c *Clock) NewTicker(d time.Duration) melody.Ticker {
+	if d <= 0 {
+		panic("melodytest: non-positive interval for NewTicker")
+	}
+
+	return ticker{c.add(&timer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+// AfterFunc returns a timer calling f once the clock has advanced by d, see Advance.
+func (c *Clock) AfterFunc(d time.Duration, f func()) melody.Timer {
+	return c.add(&timer{f: f}, d)
+}
+
+func (c *Clock) add(t *timer, d time.Duration) *timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t.clock = c
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+
+	// Like the time package, timers with a non-positive duration fire right away.
+	if d <= 0 {
+		c.timers = c.timers[:len(c.timers)-1]
+		t.fire()
+	}
+
+	return t
+}
+
+// remove unschedules t and reports whether it was scheduled, c.mu must be held.
+func (c *Clock) remove(t *timer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// timer is a timer or ticker of a Clock.
+type timer struct {
+	clock  *Clock
+	when   time.Time
+	period time.Duration // for tickers
+	c      chan time.Time
+	f      func()
+}
+
+// fire delivers the tick and reschedules tickers, t.clock.mu must be held.
+func (t *timer) fire() {
+	if t.f != nil {
+		go t.f()
+	} else {
+		select {
+		case t.c <- t.when:
+		default:
+		}
+	}
+
+	if t.period > 0 {
+		t.when = t.when.Add(t.period)
+		t.clock.timers = append(t.clock.timers, t)
+	}
+}
+
+// ticker is a ticker of a Clock.
+type ticker struct {
+	*timer
+}
+
+func (t ticker) Stop() {
+	t.timer.Stop()
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	return t.clock.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	active := t.clock.remove(t)
+	t.clock.mu.Unlock()
+
+	t.clock.add(t, d)
+
+	return active
+}
@@ -0,0 +1,248 @@
+package melodytest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+)
+
+type frame struct {
+	t    int
+	data []byte
+}
+
+// addr is the address of both ends of a pipe.
+type addr struct{}
+
+func (addr) Network() string { return "pipe" }
+func (addr) String() string  { return "pipe" }
+
+// conn is the server end of a pipe, the client end is a Client.
+type conn struct {
+	clock      melody.Clock
+	toClient   chan frame
+	fromClient chan frame
+	pongs      chan []byte
+	closed     chan struct{}
+	dropped    chan struct{}
+	closeOnce  sync.Once
+	dropOnce   sync.Once
+	ignore     atomic.Bool // ignore pings
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	limit         int64
+	pong          func(string) error
+	onClose       func(int, string) error
+}
+
+var _ melody.Conn = (*conn)(nil)
+
+func newConn(clock melody.Clock, size int) *conn {
+	return &conn{
+		clock:      clock,
+		toClient:   make(chan frame, size),
+		fromClient: make(chan frame),
+		pongs:      make(chan []byte, 1),
+		closed:     make(chan struct{}),
+		dropped:    make(chan struct{}),
+	}
+}
+
+// after returns a channel firing at deadline on the clock, nil for the zero deadline.
+func (c *conn) after(deadline time.Time) (<-chan time.Time, func()) {
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+
+	timer := c.clock.NewTimer(deadline.Sub(c.clock.Now()))
+
+	return timer.C(), func() { timer.Stop() }
+}
+
+func (c *conn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		limit := c.limit
+		c.mu.Unlock()
+
+		timeout, stop := c.after(deadline)
+
+		select {
+		case data := <-c.pongs:
+			stop()
+
+			c.mu.Lock()
+			pong := c.pong
+			c.mu.Unlock()
+
+			if pong != nil {
+				if err := pong(string(data)); err != nil {
+					return 0, nil, err
+				}
+			}
+		case f := <-c.fromClient:
+			stop()
+
+			if f.t == websocket.CloseMessage {
+				return 0, nil, c.receiveClose(f.data)
+			}
+
+			if limit > 0 && int64(len(f.data)) > limit {
+				return 0, nil, websocket.ErrReadLimit
+			}
+
+			return f.t, f.data, nil
+		case <-c.dropped:
+			stop()
+			return 0, nil, &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+		case <-c.closed:
+			stop()
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			c.mu.Lock()
+			extended := !c.readDeadline.Equal(deadline)
+			c.mu.Unlock()
+
+			if !extended {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+		}
+	}
+}
+
+// receiveClose handles a close message from the client like *websocket.Conn does.
+func (c *conn) receiveClose(data []byte) error {
+	code, text := websocket.CloseNoStatusReceived, ""
+	if len(data) >= 2 {
+		code, text = int(binary.BigEndian.Uint16(data)), string(data[2:])
+	}
+
+	c.mu.Lock()
+	onClose := c.onClose
+	c.mu.Unlock()
+
+	if onClose != nil {
+		if err := onClose(code, text); err != nil {
+			return err
+		}
+	} else {
+		c.WriteControl(websocket.CloseMessage, melody.FormatCloseMessage(code, ""), c.clock.Now())
+	}
+
+	return &websocket.CloseError{Code: code, Text: text}
+}
+
+func (c *conn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	return c.write(frame{t: messageType, data: append([]byte(nil), data...)}, deadline)
+}
+
+func (c *conn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.write(frame{t: messageType, data: append([]byte(nil), data...)}, deadline)
+}
+
+// write passes f to the client, waiting until deadline if the client is not reading.
+func (c *conn) write(f frame, deadline time.Time) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.dropped:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	switch f.t {
+	case websocket.PingMessage:
+		if !c.ignore.Load() {
+			select {
+			case c.pongs <- f.data:
+			default:
+			}
+		}
+		return nil
+	case websocket.PongMessage:
+		return nil
+	}
+
+	select {
+	case c.toClient <- f:
+		return nil
+	default:
+	}
+
+	timeout, stop := c.after(deadline)
+	defer stop()
+
+	select {
+	case c.toClient <- f:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	case <-c.dropped:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *conn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pong = h
+	c.mu.Unlock()
+}
+
+func (c *conn) SetCloseHandler(h func(code int, text string) error) {
+	c.mu.Lock()
+	c.onClose = h
+	c.mu.Unlock()
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *conn) drop() {
+	c.dropOnce.Do(func() { close(c.dropped) })
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return addr{}
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return addr{}
+}
@@ -0,0 +1,190 @@
+package melodytest
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/olahol/melody"
+)
+
+func TestClient(t *testing.T) {
+	m := melody.New()
+	m.HandleMessage(func(s *melody.Session, msg []byte) {
+		m.Broadcast(msg)
+	})
+	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
+		s.WriteBinary(msg)
+	})
+
+	closed := make(chan int, 1)
+	m.HandleClose(func(s *melody.Session, code int, text string) error {
+		closed <- code
+		return nil
+	})
+
+	c := (&Dialer{Keys: map[string]any{"name": "gopher"}}).Dial(m)
+
+	s := c.Session()
+	if s == nil {
+		t.Fatal("session did not connect")
+	}
+	if s.MustGet("name") != "gopher" {
+		t.Errorf("unexpected keys %v", s.Keys)
+	}
+
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.Expect(t, []byte("hello"))
+
+	if err := c.SendBinary([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	c.ExpectBinary(t, []byte{1, 2, 3})
+	c.ExpectNothing(t, 10*time.Millisecond)
+
+	if err := c.Close(melody.CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	c.ExpectDisconnect(t)
+
+	if code := <-closed; code != melody.CloseGoingAway {
+		t.Errorf("expected close code %d, got %d", melody.CloseGoingAway, code)
+	}
+
+	other := Dial(m)
+	other.Session()
+	m.CloseWithMsg(melody.FormatCloseMessage(melody.CloseServiceRestart, ""))
+	other.ExpectClose(t, melody.CloseServiceRestart)
+	other.ExpectDisconnect(t)
+}
+
+func TestClientDrop(t *testing.T) {
+	disconnected := make(chan struct{})
+
+	m := melody.New()
+	m.HandleDisconnect(func(s *melody.Session) {
+		close(disconnected)
+	})
+
+	c := Dial(m)
+	c.Session()
+	c.Drop()
+	c.ExpectDisconnect(t)
+	<-disconnected
+
+	if m.Len() != 0 {
+		t.Errorf("expected no sessions, got %d", m.Len())
+	}
+}
+
+func TestClockPingPong(t *testing.T) {
+	clock := NewClock()
+	pongs := make(chan struct{}, 1)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.HandlePong(func(s *melody.Session) {
+		pongs <- struct{}{}
+	})
+
+	c := Dial(m)
+	c.Session()
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(m.Config.PingPeriod)
+		<-pongs
+	}
+
+	select {
+	case <-c.Done():
+		t.Fatal("session with answered pings disconnected")
+	default:
+	}
+
+	c.IgnorePings(true)
+	clock.Advance(m.Config.PingPeriod)
+	clock.Advance(m.Config.PongWait)
+	c.ExpectDisconnect(t)
+
+	if err := c.Err(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestClockSlowReader(t *testing.T) {
+	clock := NewClock()
+	errs := make(chan error, 1)
+
+	m := melody.New()
+	m.Config.Clock = clock
+	m.HandleError(func(s *melody.Session, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	c := (&Dialer{BufferSize: 1}).Dial(m)
+	s := c.Session()
+
+	for i := 0; i < 3; i++ {
+		s.Write([]byte("slow"))
+	}
+
+	for done := false; !done; {
+		select {
+		case <-c.Done():
+			done = true
+		case <-time.After(time.Millisecond):
+			clock.Advance(m.Config.WriteWait / 10)
+		}
+	}
+
+	if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected write deadline to be exceeded, got %v", err)
+	}
+
+	c.Expect(t, []byte("slow"))
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock()
+	start := clock.Now()
+
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(400 * time.Millisecond)
+	defer ticker.Stop()
+
+	fired := make(chan struct{})
+	clock.AfterFunc(2*time.Second, func() { close(fired) })
+
+	clock.Advance(time.Second)
+
+	if got := <-timer.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("timer fired at %v", got)
+	}
+	if got := <-ticker.C(); !got.Equal(start.Add(400 * time.Millisecond)) {
+		t.Errorf("ticker fired at %v", got)
+	}
+
+	select {
+	case <-fired:
+		t.Error("AfterFunc fired early")
+	default:
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset of fired timer reported active")
+	}
+
+	clock.Advance(time.Second)
+	<-fired
+	<-timer.C()
+
+	if !clock.Now().Equal(start.Add(2 * time.Second)) {
+		t.Errorf("clock at %v", clock.Now())
+	}
+}
@@ -0,0 +1,278 @@
+package melody
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Metrics receives measurements from a melody instance, set it with Config.Metrics.
+// Implementations must be safe for concurrent use and should return quickly since
+// they are called from the read and write loops of every session.
+type Metrics interface {
+	// SessionConnected is called when a session is registered.
+	SessionConnected()
+	// SessionDisconnected is called when a session has disconnected.
+	SessionDisconnected()
+	// MessageReceived is called for every text or binary message read from a session.
+	MessageReceived(messageType int, size int)
+	// MessageSent is called for every text or binary message written to a session,
+	// latency is the time spent writing it.
+	MessageSent(messageType int, size int, latency time.Duration)
+	// MessageDropped is called when a message is dropped because a session's buffer is full.
+	MessageDropped()
+	// MessageBuffered is called when a message is added to a session's buffer,
+	// buffered is the number of messages in the buffer afterwards.
+	MessageBuffered(buffered int)
+	// Broadcast is called for every broadcast with the number of local recipients.
+	Broadcast(messageType int, size int, recipients int)
+	// Pong is called when a pong is received, rtt is the time since the last ping.
+	Pong(rtt time.Duration)
+	// MessageCompressed is called for every message written with compression to a
+	// websocket connection, compressed is the size of the frame written to the network.
+	MessageCompressed(size int, compressed int)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) SessionConnected()                   {}
+func (nopMetrics) SessionDisconnected()                {}
+func (nopMetrics) MessageReceived(int, int)            {}
+func (nopMetrics) MessageSent(int, int, time.Duration) {}
+func (nopMetrics) MessageDropped()                     {}
+func (nopMetrics) MessageBuffered(int)                 {}
+func (nopMetrics) Broadcast(int, int, int)             {}
+func (nopMetrics) Pong(time.Duration)                  {}
+func (nopMetrics) MessageCompressed(int, int)          {}
+
+// MetricsCollector is an in-process Metrics implementation. It is an http.Handler
+// that serves the collected metrics in the Prometheus text exposition format.
+type MetricsCollector struct {
+	sessions      atomic.Int64
+	sessionsTotal atomic.Uint64
+	received      [2]atomic.Uint64
+	receivedBytes [2]atomic.Uint64
+	sent          [2]atomic.Uint64
+	sentBytes     [2]atomic.Uint64
+	dropped       atomic.Uint64
+	broadcasts    [2]atomic.Uint64
+	recipients    atomic.Uint64
+	writeLatency  *histogram
+	pingRTT       *histogram
+	buffered      *histogram
+	uncompressed  atomic.Uint64
+	compressed    atomic.Uint64
+}
+
+// NewMetricsCollector creates a new metrics collector.
+func NewMetricsCollector() *MetricsCollector {
+	latencyBuckets := []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+	return &MetricsCollector{
+		writeLatency: newHistogram(latencyBuckets),
+		pingRTT:      newHistogram(latencyBuckets),
+		buffered:     newHistogram([]float64{0, 1, 4, 16, 64, 256, 1024}),
+	}
+}
+
+// messageIndex maps text and binary messages to 0 and 1, other types to -1.
+func messageIndex(messageType int) int {
+	switch messageType {
+	case websocket.TextMessage:
+		return 0
+	case websocket.BinaryMessage:
+		return 1
+	}
+	return -1
+}
+
+var messageLabels = [2]string{"text", "binary"}
+
+// SessionConnected implements Metrics.
+func (c *MetricsCollector) SessionConnected() {
+	c.sessions.Add(1)
+	c.sessionsTotal.Add(1)
+}
+
+// SessionDisconnected implements Metrics.
+func (c *MetricsCollector) SessionDisconnected() {
+	c.sessions.Add(-1)
+}
+
+// MessageReceived implements Metrics.
+func (c *MetricsCollector) MessageReceived(messageType int, size int) {
+	if i := messageIndex(messageType); i >= 0 {
+		c.received[i].Add(1)
+		c.receivedBytes[i].Add(uint64(size))
+	}
+}
+
+// MessageSent implements Metrics.
+func (c *MetricsCollector) MessageSent(messageType int, size int, latency time.Duration) {
+	if i := messageIndex(messageType); i >= 0 {
+		c.sent[i].Add(1)
+		c.sentBytes[i].Add(uint64(size))
+		c.writeLatency.observe(latency.Seconds())
+	}
+}
+
+// MessageDropped implements Metrics.
+func (c *MetricsCollector) MessageDropped() {
+	c.dropped.Add(1)
+}
+
+// MessageBuffered implements Metrics.
+func (c *MetricsCollector) MessageBuffered(buffered int) {
+	c.buffered.observe(float64(buffered))
+}
+
+// Broadcast implements Metrics.
+func (c *MetricsCollector) Broadcast(messageType int, size int, recipients int) {
+	if i := messageIndex(messageType); i >= 0 {
+		c.broadcasts[i].Add(1)
+		c.recipients.Add(uint64(recipients))
+	}
+}
+
+// Pong implements Metrics.
+func (c *MetricsCollector) Pong(rtt time.Duration) {
+	c.pingRTT.observe(rtt.Seconds())
+}
+
+// MessageCompressed implements Metrics.
+func (c *MetricsCollector) MessageCompressed(size int, compressed int) {
+	c.uncompressed.Add(uint64(size))
+	c.compressed.Add(uint64(compressed))
+}
+
+// ServeHTTP writes the collected metrics in the Prometheus text exposition format.
+func (c *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the collected metrics in the Prometheus text exposition format to w.
+func (c *MetricsCollector) WriteTo(w io.Writer) (int64, error) {
+	p := &promWriter{w: w}
+
+	p.header("melody_sessions", "gauge", "Number of connected sessions.")
+	p.sample("melody_sessions", "", float64(c.sessions.Load()))
+
+	p.header("melody_sessions_total", "counter", "Total number of sessions connected.")
+	p.sample("melody_sessions_total", "", float64(c.sessionsTotal.Load()))
+
+	p.counters("melody_messages_received_total", "Total number of messages received.", &c.received)
+	p.counters("melody_received_bytes_total", "Total number of bytes received.", &c.receivedBytes)
+	p.counters("melody_messages_sent_total", "Total number of messages sent.", &c.sent)
+	p.counters("melody_sent_bytes_total", "Total number of bytes sent.", &c.sentBytes)
+
+	p.header("melody_messages_dropped_total", "counter", "Total number of messages dropped because a session buffer was full.")
+	p.sample("melody_messages_dropped_total", "", float64(c.dropped.Load()))
+
+	p.counters("melody_broadcasts_total", "Total number of broadcasts.", &c.broadcasts)
+
+	p.header("melody_broadcast_recipients_total", "counter", "Total number of sessions reached by broadcasts.")
+	p.sample("melody_broadcast_recipients_total", "", float64(c.recipients.Load()))
+
+	p.header("melody_compression_input_bytes_total", "counter", "Total number of bytes written with compression, before compression.")
+	p.sample("melody_compression_input_bytes_total", "", float64(c.uncompressed.Load()))
+
+	p.header("melody_compression_output_bytes_total", "counter", "Total number of bytes written to the network with compression, including frame headers.")
+	p.sample("melody_compression_output_bytes_total", "", float64(c.compressed.Load()))
+
+	p.histogram("melody_write_latency_seconds", "Time spent writing messages to sessions.", c.writeLatency)
+	p.histogram("melody_ping_rtt_seconds", "Round trip time between pings and pongs.", c.pingRTT)
+	p.histogram("melody_buffered_messages", "Messages in a session buffer after buffering a message.", c.buffered)
+
+	return p.n, p.err
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64 // float64 bits
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+
+	h.count.Add(1)
+
+	for {
+		old := h.sum.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sum.CompareAndSwap(old, sum) {
+			return
+		}
+	}
+}
+
+type promWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	p.printf("%s%s %v\n", name, labels, v)
+}
+
+func (p *promWriter) counters(name, help string, values *[2]atomic.Uint64) {
+	p.header(name, "counter", help)
+	for i := range values {
+		p.sample(name, fmt.Sprintf("type=%q", messageLabels[i]), float64(values[i].Load()))
+	}
+}
+
+func (p *promWriter) histogram(name, help string, h *histogram) {
+	p.header(name, "histogram", help)
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i].Load()
+		p.sample(name+"_bucket", fmt.Sprintf("le=%q", fmt.Sprint(le)), float64(cumulative))
+	}
+
+	count := h.count.Load()
+	if count < cumulative {
+		count = cumulative
+	}
+	p.sample(name+"_bucket", `le="+Inf"`, float64(count))
+	p.sample(name+"_sum", "", math.Float64frombits(h.sum.Load()))
+	p.sample(name+"_count", "", float64(count))
+}
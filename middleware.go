@@ -0,0 +1,57 @@
+package melody
+
+// EventKind identifies the event a HandlerFunc is called for.
+type EventKind int
+
+const (
+	EventConnect       EventKind = iota // A session connected, see HandleConnect.
+	EventDisconnect                     // A session disconnected, see HandleDisconnect.
+	EventMessage                        // A text message came in, see HandleMessage.
+	EventMessageBinary                  // A binary message came in, see HandleMessageBinary.
+	EventResume                         // A session resumed a disconnected session, see HandleResume.
+)
+
+// HandlerFunc handles an event of a session. msg is nil for connect, disconnect and resume events.
+type HandlerFunc func(s *Session, kind EventKind, msg []byte)
+
+// Middleware wraps the handling of session events. A middleware calls next to
+// continue handling the event, possibly with a modified msg, or returns without
+// calling it to stop the event from reaching the remaining middleware and handlers.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Use appends middleware to the chain wrapping the connect, disconnect, message
+// and binary message handlers. Middleware runs in the order it was added, the
+// handlers set with HandleConnect, HandleDisconnect, HandleMessage and
+// HandleMessageBinary run at the end of the chain.
+func (m *Melody) Use(middleware ...Middleware) {
+	m.middleware = append(m.middleware, middleware...)
+
+	handler := HandlerFunc(m.dispatch)
+	for i := len(m.middleware) - 1; i >= 0; i-- {
+		handler = m.middleware[i](handler)
+	}
+
+	m.handler = handler
+}
+
+// dispatch is the end of the middleware chain.
+func (m *Melody) dispatch(s *Session, kind EventKind, msg []byte) {
+	switch kind {
+	case EventConnect:
+		m.connectHandler(s)
+	case EventDisconnect:
+		m.disconnectHandler(s, s.CloseReason())
+	case EventMessage:
+		if !m.dispatchFrame(s, msg) {
+			m.messageHandler(s, msg)
+		}
+	case EventMessageBinary:
+		m.messageHandlerBinary(s, msg)
+	case EventResume:
+		if m.resumeHandler != nil {
+			m.resumeHandler(s)
+		} else {
+			m.connectHandler(s)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package melody
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decides what happens to a message written to a session
+// whose message buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the message being written.
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered message to make room. A
+	// buffered close message is never dropped, the new message is instead.
+	OverflowDropOldest
+	// OverflowBlock waits up to Config.OverflowTimeout for room in the buffer
+	// before dropping the message. The writing goroutine blocks while it waits,
+	// a broadcast waits for each full session in turn. Other sessions and
+	// broadcasts are not held up.
+	OverflowBlock
+	// OverflowClose closes the session with CloseTryAgainLater.
+	OverflowClose
+	// OverflowCoalesce replaces a buffered message with a newer message written
+	// with the same key, see Session.WriteKeyed. Messages without a key are
+	// dropped as with OverflowDropNewest.
+	OverflowCoalesce
+)
+
+// overflow handles message when the output buffer is full.
+func (s *Session) overflow(message envelope) {
+	switch s.melody.Config.OverflowPolicy {
+	case OverflowDropOldest:
+		for i := 0; i < 2; i++ {
+			select {
+			case oldest := <-s.output:
+				if oldest.t == websocket.CloseMessage {
+					s.requeue(oldest)
+					s.dropped()
+					return
+				}
+				s.dropped()
+			default:
+			}
+
+			select {
+			case s.output <- message:
+				s.buffered()
+				return
+			default:
+			}
+		}
+	case OverflowBlock:
+		timer := s.melody.Config.Clock.NewTimer(s.melody.Config.OverflowTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.output <- message:
+			s.buffered()
+			return
+		case <-s.outputDone:
+			s.melody.errorHandler(s, ErrWriteClosed)
+			return
+		case <-timer.C():
+		}
+	case OverflowClose:
+		s.dropped()
+		if s.overflowed.CompareAndSwap(false, true) {
+			// The close message is written past the full buffer to a slow client, don't wait on it.
+			go s.terminate(CloseTryAgainLater, "", ErrMessageBufferFull)
+		}
+		return
+	}
+
+	s.dropped()
+}
+
+// requeue buffers a close message taken off the buffer again so that it is never
+// dropped, waiting for room if another write took its place.
+func (s *Session) requeue(message envelope) {
+	select {
+	case s.output <- message:
+	case <-s.outputDone:
+	}
+}
+
+// dropped reports a message dropped because the buffer is full.
+func (s *Session) dropped() {
+	s.melody.Config.Metrics.MessageDropped()
+	s.melody.errorHandler(s, ErrMessageBufferFull)
+}
+
+// buffered reports a message added to the buffer.
+func (s *Session) buffered() {
+	s.melody.Config.Metrics.MessageBuffered(len(s.output))
+}
+
+// coalesce buffers message so that it replaces any buffered message with the same key.
+func (s *Session) coalesce(message envelope) {
+	s.keyedMu.Lock()
+	if s.keyed == nil {
+		s.keyed = make(map[string]envelope)
+	}
+	_, pending := s.keyed[message.key]
+	s.keyed[message.key] = message
+	s.keyedMu.Unlock()
+
+	if pending {
+		return
+	}
+
+	select {
+	case s.output <- envelope{key: message.key}:
+		s.buffered()
+	default:
+		s.keyedMu.Lock()
+		delete(s.keyed, message.key)
+		s.keyedMu.Unlock()
+
+		s.dropped()
+	}
+}
+
+// uncoalesce returns the latest message buffered with key.
+func (s *Session) uncoalesce(key string) (envelope, bool) {
+	s.keyedMu.Lock()
+	defer s.keyedMu.Unlock()
+
+	message, ok := s.keyed[key]
+	delete(s.keyed, key)
+
+	return message, ok
+}
+
+// WriteKeyed writes a text message to the session. With Config.OverflowPolicy
+// set to OverflowCoalesce, a message written with the same key that is still
+// buffered is replaced by msg instead of msg being buffered behind it.
+func (s *Session) WriteKeyed(key string, msg []byte) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	s.writeMessage(envelope{t: websocket.TextMessage, msg: msg, key: key})
+
+	return nil
+}
+
+// BroadcastKeyed broadcasts a text message to all sessions, coalescing it
+// with buffered messages that have the same key, see Session.WriteKeyed.
+func (m *Melody) BroadcastKeyed(key string, msg []byte) error {
+	if m.hub.closed() {
+		return ErrClosed
+	}
+
+	message := envelope{t: websocket.TextMessage, msg: msg, key: key}
+
+	return m.broadcast(message, "")
+}
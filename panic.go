@@ -0,0 +1,34 @@
+package melody
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is reported to the error handler when a handler panics and no
+// panic handler has been set with HandlePanic.
+type PanicError struct {
+	Value any    // Value passed to panic.
+	Stack []byte // Stack trace of the panicking goroutine.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("melody: handler panic: %v", e.Value)
+}
+
+// recoverPanic recovers a panic in a handler called for the session, it must be deferred directly.
+func (s *Session) recoverPanic() {
+	v := recover()
+
+	if v == nil {
+		return
+	}
+
+	stack := debug.Stack()
+
+	s.melody.panicHandler(s, v, stack)
+
+	if s.melody.Config.CloseOnPanic && !s.closed() {
+		s.terminate(CloseInternalServerErr, "", &PanicError{Value: v, Stack: stack})
+	}
+}
@@ -0,0 +1,166 @@
+package melody
+
+import "sync"
+
+// pool is a fixed set of workers handling messages, see Config.WorkerPoolSize.
+type pool struct {
+	once sync.Once
+	jobs chan func()
+	done chan struct{}
+	stop sync.Once
+}
+
+func (p *pool) start(size, queue int) {
+	p.once.Do(func() {
+		p.jobs = make(chan func(), queue)
+		p.done = make(chan struct{})
+
+		for i := 0; i < size; i++ {
+			go p.work()
+		}
+	})
+}
+
+func (p *pool) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// submit queues job, waiting for room until cancel is closed if block is set.
+// It reports whether the job was queued.
+func (p *pool) submit(job func(), block bool, cancel <-chan struct{}) bool {
+	if block {
+		select {
+		case p.jobs <- job:
+			return true
+		case <-cancel:
+			return false
+		}
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pool) close() {
+	p.once.Do(func() {})
+	p.stop.Do(func() {
+		if p.done != nil {
+			close(p.done)
+		}
+	})
+}
+
+// maxInFlight returns how many messages of a session may be queued or handled by the pool at once,
+// 0 for no limit. Sessions preserving message order queue their messages themselves, so they are
+// limited to WorkerQueueSize unless MaxInFlight is set.
+func (m *Melody) maxInFlight() int {
+	if m.Config.MaxInFlight > 0 || m.Config.WorkerPoolSize <= 0 || !m.Config.PreserveMessageOrder {
+		return m.Config.MaxInFlight
+	}
+
+	if m.Config.WorkerQueueSize > 0 {
+		return m.Config.WorkerQueueSize
+	}
+
+	return 1
+}
+
+type inbound struct {
+	t   int
+	msg []byte
+}
+
+// schedule hands a message to the worker pool.
+func (s *Session) schedule(t int, message []byte) {
+	m := s.melody
+	block := !m.Config.ShedWhenSaturated
+
+	m.pool.start(m.Config.WorkerPoolSize, m.Config.WorkerQueueSize)
+
+	if s.inflight != nil {
+		if block {
+			select {
+			case s.inflight <- struct{}{}:
+			case <-s.outputDone:
+				return
+			}
+		} else {
+			select {
+			case s.inflight <- struct{}{}:
+			default:
+				m.errorHandler(s, ErrWorkerPoolFull)
+				return
+			}
+		}
+	}
+
+	if !m.Config.PreserveMessageOrder {
+		job := func() {
+			defer s.release()
+			s.handleMessage(t, message)
+		}
+
+		if !m.pool.submit(job, block, s.outputDone) {
+			s.release()
+			m.errorHandler(s, ErrWorkerPoolFull)
+		}
+
+		return
+	}
+
+	s.queueMu.Lock()
+	s.queue = append(s.queue, inbound{t: t, msg: message})
+	if s.draining {
+		s.queueMu.Unlock()
+		return
+	}
+	s.draining = true
+	s.queueMu.Unlock()
+
+	if !m.pool.submit(s.drain, block, s.outputDone) {
+		s.queueMu.Lock()
+		for range s.queue {
+			s.release()
+		}
+		s.queue = nil
+		s.draining = false
+		s.queueMu.Unlock()
+
+		m.errorHandler(s, ErrWorkerPoolFull)
+	}
+}
+
+// drain handles the queued messages of the session in order.
+func (s *Session) drain() {
+	for {
+		s.queueMu.Lock()
+		if len(s.queue) == 0 {
+			s.draining = false
+			s.queueMu.Unlock()
+			return
+		}
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queueMu.Unlock()
+
+		s.handleMessage(next.t, next.msg)
+		s.release()
+	}
+}
+
+func (s *Session) release() {
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
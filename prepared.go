@@ -0,0 +1,23 @@
+package melody
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// prepared is shared by the envelopes of a broadcast so that the message is
+// framed, and compressed, once per broadcast rather than once per session.
+type prepared struct {
+	once sync.Once
+	pm   *websocket.PreparedMessage
+	err  error
+}
+
+func (p *prepared) message(t int, msg []byte) (*websocket.PreparedMessage, error) {
+	p.once.Do(func() {
+		p.pm, p.err = websocket.NewPreparedMessage(t, msg)
+	})
+
+	return p.pm, p.err
+}
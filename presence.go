@@ -0,0 +1,315 @@
+package melody
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// PresenceEventName is the event presence events are written to sessions as, see Config.PresenceBroadcast.
+const PresenceEventName = "presence"
+
+// PresenceKind identifies what a PresenceEvent reports.
+type PresenceKind string
+
+const (
+	PresenceJoin   PresenceKind = "join"   // The first session of a user joined the room.
+	PresenceLeave  PresenceKind = "leave"  // The last session of a user left the room.
+	PresenceUpdate PresenceKind = "update" // The metadata of a user present in the room changed.
+)
+
+// PresenceInfo is a user present in a room.
+type PresenceInfo struct {
+	User string `json:"user"`
+	Meta any    `json:"meta,omitempty"`
+}
+
+// PresenceEvent reports a change of the users present in a room. Room is empty for
+// the presence of users across all connected sessions.
+type PresenceEvent struct {
+	Kind PresenceKind `json:"kind"`
+	Room string       `json:"room"`
+	PresenceInfo
+}
+
+// Presence tracks which users are present in each room. The user of a session is the
+// string stored under Config.PresenceKey in its Keys, sessions without it are not tracked.
+// A user is present in a room while at least one of its sessions is a member, and in the
+// room "" while at least one of its sessions is connected. Presence only knows about the
+// sessions of this melody instance.
+type Presence struct {
+	melody   *Melody
+	mu       sync.Mutex
+	rooms    map[string]map[string]*member
+	sessions map[*Session]*tracked
+}
+
+// member is a user present in a room.
+type member struct {
+	sessions map[*Session]struct{}
+	meta     any
+	leaving  Timer // pending leave while debounced
+}
+
+// tracked is the user of a session and the rooms it is counted in.
+type tracked struct {
+	user  string
+	rooms map[string]struct{}
+}
+
+func newPresence(m *Melody) *Presence {
+	return &Presence{
+		melody:   m,
+		rooms:    make(map[string]map[string]*member),
+		sessions: make(map[*Session]*tracked),
+	}
+}
+
+// Presence returns the presence of users in rooms, see Config.PresenceKey.
+func (m *Melody) Presence() *Presence {
+	return m.presence
+}
+
+// HandlePresence fires fn when a user joins or leaves a room or its metadata is updated, see Presence.
+func (m *Melody) HandlePresence(fn func(PresenceEvent)) {
+	m.presenceHandler = fn
+}
+
+// List returns the users present in room sorted by user, use "" for all connected users.
+func (p *Presence) List(room string) []PresenceInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	members := p.rooms[room]
+	result := make([]PresenceInfo, 0, len(members))
+	for user, mem := range members {
+		result = append(result, PresenceInfo{User: user, Meta: mem.meta})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].User < result[j].User
+	})
+
+	return result
+}
+
+// Update sets the metadata of the user of s and reports it to every room the user is present in.
+func (p *Presence) Update(s *Session, meta any) error {
+	p.mu.Lock()
+
+	t, ok := p.sessions[s]
+	if !ok {
+		p.mu.Unlock()
+		return ErrNotTracked
+	}
+
+	var events []PresenceEvent
+
+	for room, members := range p.rooms {
+		if mem, ok := members[t.user]; ok {
+			mem.meta = meta
+			events = append(events, PresenceEvent{Kind: PresenceUpdate, Room: room, PresenceInfo: PresenceInfo{User: t.user, Meta: meta}})
+		}
+	}
+
+	p.mu.Unlock()
+
+	p.emit(events...)
+
+	return nil
+}
+
+// user returns the user of s, or false if s is not tracked.
+func (p *Presence) user(s *Session) (string, bool) {
+	if p.melody.Config.PresenceKey == "" {
+		return "", false
+	}
+
+	value, ok := s.Get(p.melody.Config.PresenceKey)
+	if !ok {
+		return "", false
+	}
+
+	user, ok := value.(string)
+
+	return user, ok && user != ""
+}
+
+// track counts s in the room "" and in the rooms it is a member of.
+func (p *Presence) track(s *Session) {
+	user, ok := p.user(s)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	if _, ok := p.sessions[s]; !ok {
+		p.sessions[s] = &tracked{user: user, rooms: make(map[string]struct{})}
+	}
+	p.mu.Unlock()
+
+	p.join(s, "")
+
+	for _, room := range s.Rooms() {
+		p.join(s, room)
+	}
+}
+
+// untrack removes s from every room it is counted in.
+func (p *Presence) untrack(s *Session) {
+	p.mu.Lock()
+
+	t, ok := p.sessions[s]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	var events []PresenceEvent
+
+	for room := range t.rooms {
+		if e, ok := p.remove(s, t, room); ok {
+			events = append(events, e)
+		}
+	}
+
+	delete(p.sessions, s)
+
+	p.mu.Unlock()
+
+	p.emit(events...)
+}
+
+// join counts s in room. Sessions that are not tracked yet are counted in their rooms by track,
+// sessions that have been untracked are not counted again.
+func (p *Presence) join(s *Session, room string) {
+	p.mu.Lock()
+
+	t, ok := p.sessions[s]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	if _, ok := t.rooms[room]; ok {
+		p.mu.Unlock()
+		return
+	}
+
+	t.rooms[room] = struct{}{}
+
+	members, ok := p.rooms[room]
+	if !ok {
+		members = make(map[string]*member)
+		p.rooms[room] = members
+	}
+
+	var events []PresenceEvent
+
+	mem, ok := members[t.user]
+	if !ok {
+		mem = &member{sessions: make(map[*Session]struct{})}
+		members[t.user] = mem
+		events = append(events, PresenceEvent{Kind: PresenceJoin, Room: room, PresenceInfo: PresenceInfo{User: t.user}})
+	}
+
+	if mem.leaving != nil {
+		mem.leaving.Stop()
+		mem.leaving = nil
+	}
+
+	mem.sessions[s] = struct{}{}
+
+	p.mu.Unlock()
+
+	p.emit(events...)
+}
+
+func (p *Presence) leave(s *Session, room string) {
+	p.mu.Lock()
+
+	t, ok := p.sessions[s]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	e, ok := p.remove(s, t, room)
+
+	p.mu.Unlock()
+
+	if ok {
+		p.emit(e)
+	}
+}
+
+// remove uncounts s from room and returns the leave event if it was the last session of its user,
+// unless the leave is debounced. p.mu must be held.
+func (p *Presence) remove(s *Session, t *tracked, room string) (PresenceEvent, bool) {
+	if _, ok := t.rooms[room]; !ok {
+		return PresenceEvent{}, false
+	}
+
+	delete(t.rooms, room)
+
+	mem := p.rooms[room][t.user]
+	delete(mem.sessions, s)
+
+	if len(mem.sessions) > 0 {
+		return PresenceEvent{}, false
+	}
+
+	if debounce := p.melody.Config.PresenceDebounce; debounce > 0 {
+		var timer Timer
+		timer = p.melody.Config.Clock.AfterFunc(debounce, func() {
+			p.mu.Lock()
+			if mem.leaving != timer {
+				p.mu.Unlock()
+				return
+			}
+			e := p.drop(room, t.user)
+			p.mu.Unlock()
+
+			p.emit(e)
+		})
+		mem.leaving = timer
+
+		return PresenceEvent{}, false
+	}
+
+	return p.drop(room, t.user), true
+}
+
+// drop removes user from room, p.mu must be held.
+func (p *Presence) drop(room, user string) PresenceEvent {
+	members := p.rooms[room]
+	mem := members[user]
+
+	delete(members, user)
+	if len(members) == 0 {
+		delete(p.rooms, room)
+	}
+
+	return PresenceEvent{Kind: PresenceLeave, Room: room, PresenceInfo: PresenceInfo{User: user, Meta: mem.meta}}
+}
+
+// emit passes events to the presence handler and, with Config.PresenceBroadcast, writes them to the
+// sessions of this instance in their room, as presence is not shared through the backplane.
+func (p *Presence) emit(events ...PresenceEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	for _, e := range events {
+		p.melody.presenceHandler(e)
+
+		if !p.melody.Config.PresenceBroadcast || p.melody.hub.closed() {
+			continue
+		}
+
+		if msg, err := encodeEvent(PresenceEventName, e); err == nil {
+			p.melody.deliver(envelope{t: websocket.TextMessage, msg: msg}, e.Room)
+		}
+	}
+}
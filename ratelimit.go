@@ -0,0 +1,256 @@
+package melody
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit configures token bucket limits on inbound messages.
+// A zero rate disables the corresponding limit.
+type RateLimit struct {
+	Messages     float64 // Messages per second.
+	MessageBurst int     // Maximum number of messages in a burst, defaults to Messages.
+	Bytes        float64 // Bytes per second.
+	ByteBurst    int     // Maximum number of bytes in a burst, defaults to Bytes.
+}
+
+func (r RateLimit) enabled() bool {
+	return r.Messages > 0 || r.Bytes > 0
+}
+
+// RateLimitAction decides what happens to a message that exceeds a rate limit.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the message.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDelay waits until the message is within the limit before handling
+	// it. No further messages are read from the session while waiting.
+	RateLimitDelay
+	// RateLimitWarn writes Config.RateLimitWarning to the session and drops the message.
+	RateLimitWarn
+	// RateLimitClose closes the session with ClosePolicyViolation.
+	RateLimitClose
+)
+
+// RateLimitViolation describes a message that exceeded a rate limit, see HandleRateLimit.
+type RateLimitViolation struct {
+	IP     bool            // Whether the limit of the remote IP, rather than the session, was exceeded.
+	Size   int             // Size of the message in bytes.
+	Action RateLimitAction // Action taken.
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	b := tokenBucket{rate: rate, burst: float64(burst)}
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) refill(elapsed time.Duration) {
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// wait returns how long until n tokens are available.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	if n > b.burst {
+		n = b.burst
+	}
+	b.tokens -= n
+}
+
+type limiter struct {
+	mu       sync.Mutex
+	messages tokenBucket
+	bytes    tokenBucket
+	last     time.Time
+	refs     int // sessions sharing an IP limiter, guarded by rateLimits.mu
+}
+
+func newLimiter(r RateLimit, now time.Time) *limiter {
+	if !r.enabled() {
+		return nil
+	}
+
+	return &limiter{
+		messages: newTokenBucket(r.Messages, r.MessageBurst),
+		bytes:    newTokenBucket(r.Bytes, r.ByteBurst),
+		last:     now,
+	}
+}
+
+// wait refills the buckets and returns how long until a message of size fits, l.mu must be held.
+func (l *limiter) wait(size int, now time.Time) time.Duration {
+	l.messages.refill(now.Sub(l.last))
+	l.bytes.refill(now.Sub(l.last))
+	l.last = now
+
+	wait := l.messages.wait(1)
+	if w := l.bytes.wait(float64(size)); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+// take consumes the tokens for a message of size, l.mu must be held.
+func (l *limiter) take(size int) {
+	l.messages.take(1)
+	l.bytes.take(float64(size))
+}
+
+// rateLimits holds the limiters shared by sessions from the same remote IP.
+type rateLimits struct {
+	mu  sync.Mutex
+	ips map[string]*limiter
+}
+
+func (r *rateLimits) acquire(ip string, limit RateLimit, now time.Time) *limiter {
+	if !limit.enabled() {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ips == nil {
+		r.ips = make(map[string]*limiter)
+	}
+
+	l, ok := r.ips[ip]
+	if !ok {
+		l = newLimiter(limit, now)
+		r.ips[ip] = l
+	}
+	l.refs++
+
+	return l
+}
+
+func (r *rateLimits) release(ip string, l *limiter) {
+	if l == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(r.ips, ip)
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// reserve returns how long until a message of size is within the session and IP limits,
+// consuming the tokens for it if that is now. ip reports which limit was exceeded.
+func (s *Session) reserve(size int) (wait time.Duration, ip bool) {
+	now := s.melody.now()
+
+	if s.limiter != nil {
+		s.limiter.mu.Lock()
+		defer s.limiter.mu.Unlock()
+
+		wait = s.limiter.wait(size, now)
+	}
+
+	if s.ipLimiter != nil {
+		s.ipLimiter.mu.Lock()
+		defer s.ipLimiter.mu.Unlock()
+
+		if w := s.ipLimiter.wait(size, now); w > wait {
+			wait, ip = w, true
+		}
+	}
+
+	if wait > 0 {
+		return wait, ip
+	}
+
+	if s.limiter != nil {
+		s.limiter.take(size)
+	}
+
+	if s.ipLimiter != nil {
+		s.ipLimiter.take(size)
+	}
+
+	return 0, false
+}
+
+// limit applies the rate limits to an inbound message of size and reports whether it should be handled.
+func (s *Session) limit(size int) bool {
+	if s.limiter == nil && s.ipLimiter == nil {
+		return true
+	}
+
+	wait, ip := s.reserve(size)
+
+	if wait == 0 {
+		return true
+	}
+
+	action := s.melody.Config.RateLimitAction
+
+	s.rateLimited(RateLimitViolation{IP: ip, Size: size, Action: action})
+
+	switch action {
+	case RateLimitDelay:
+		for wait > 0 {
+			s.melody.sleep(wait)
+			wait, _ = s.reserve(size)
+		}
+		return true
+	case RateLimitWarn:
+		if s.melody.Config.RateLimitWarning != nil {
+			s.Write(s.melody.Config.RateLimitWarning)
+		}
+	case RateLimitClose:
+		s.terminate(ClosePolicyViolation, "rate limit exceeded", ErrRateLimited)
+	}
+
+	return false
+}
+
+func (s *Session) rateLimited(violation RateLimitViolation) {
+	defer s.recoverPanic()
+
+	s.melody.rateLimitHandler(s, violation)
+}
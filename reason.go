@@ -0,0 +1,73 @@
+package melody
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseInitiator tells which side ended a session, see CloseReason.
+type CloseInitiator int
+
+const (
+	// InitiatorServer means the session was closed by melody or the application.
+	InitiatorServer CloseInitiator = iota + 1
+	// InitiatorClient means the client sent a close message or went away.
+	InitiatorClient
+	// InitiatorNetwork means the connection failed, a read or write errored or timed out.
+	InitiatorNetwork
+)
+
+// CloseReason describes why a session disconnected, see Session.CloseReason and HandleDisconnectWithReason.
+type CloseReason struct {
+	Initiator CloseInitiator // Which side ended the session.
+	Code      int            // Close code sent or received, CloseAbnormalClosure if there was no close message.
+	Text      string         // Close text sent or received.
+	Err       error          // Error that ended the session, e.g. ErrIdleTimeout or ErrClosed, nil for a plain close.
+}
+
+// setCloseReason records why the session is closing, the first reason recorded wins.
+func (s *Session) setCloseReason(reason CloseReason) {
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	if s.reason.Initiator == 0 {
+		s.reason = reason
+	}
+}
+
+// CloseReason returns why the session disconnected. It returns the zero CloseReason while the
+// session is open.
+func (s *Session) CloseReason() CloseReason {
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+
+	return s.reason
+}
+
+// serverClose returns the reason for a close message msg written by the server.
+func serverClose(msg []byte, err error) CloseReason {
+	reason := CloseReason{Initiator: InitiatorServer, Code: CloseNoStatusReceived, Err: err}
+
+	if len(msg) >= 2 {
+		reason.Code = int(binary.BigEndian.Uint16(msg))
+		reason.Text = string(msg[2:])
+	}
+
+	return reason
+}
+
+// readClose returns the reason for the error that stopped the session from reading.
+func readClose(err error) CloseReason {
+	var closeErr *websocket.CloseError
+
+	switch {
+	case errors.As(err, &closeErr) && closeErr.Code != CloseAbnormalClosure:
+		return CloseReason{Initiator: InitiatorClient, Code: closeErr.Code, Text: closeErr.Text}
+	case errors.Is(err, websocket.ErrReadLimit):
+		return CloseReason{Initiator: InitiatorServer, Code: CloseMessageTooBig, Err: err}
+	default:
+		return CloseReason{Initiator: InitiatorNetwork, Code: CloseAbnormalClosure, Err: err}
+	}
+}
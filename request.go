@@ -0,0 +1,167 @@
+package melody
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requests tracks the requests of a session that are waiting for a reply.
+type requests struct {
+	mu      sync.Mutex
+	pending map[string]chan []byte
+	waiting atomic.Int32
+	seq     atomic.Uint64
+	done    bool
+}
+
+func (r *requests) add() (string, chan []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return "", nil, false
+	}
+
+	if r.pending == nil {
+		r.pending = make(map[string]chan []byte)
+	}
+
+	id := strconv.FormatUint(r.seq.Add(1), 10)
+	reply := make(chan []byte, 1)
+	r.pending[id] = reply
+	r.waiting.Add(1)
+
+	return id, reply, true
+}
+
+func (r *requests) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pending[id]; ok {
+		delete(r.pending, id)
+		r.waiting.Add(-1)
+	}
+}
+
+// resolve delivers msg to the request it replies to and reports whether there was one.
+func (r *requests) resolve(msg []byte) bool {
+	if r.waiting.Load() == 0 {
+		return false
+	}
+
+	var f frame
+
+	if err := json.Unmarshal(msg, &f); err != nil || f.ReplyTo == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply, ok := r.pending[f.ReplyTo]
+
+	if !ok {
+		return false
+	}
+
+	delete(r.pending, f.ReplyTo)
+	r.waiting.Add(-1)
+	reply <- f.Data
+
+	return true
+}
+
+// cancel fails all pending requests, no new requests can be added afterwards.
+func (r *requests) cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done = true
+
+	for id, reply := range r.pending {
+		close(reply)
+		delete(r.pending, id)
+	}
+	r.waiting.Store(0)
+}
+
+// SendRequest writes payload to the session as {"id": ..., "data": payload} and waits for the
+// client to answer with {"reply_to": ..., "data": ...}, returning the data of the reply.
+// The payload must be valid JSON. If ctx has no deadline Config.RequestTimeout is used.
+// Replies are read by the session's read loop, so unless Config.ConcurrentMessageHandling
+// is set a message handler must not wait on a request to its own session.
+func (s *Session) SendRequest(ctx context.Context, payload []byte) ([]byte, error) {
+	if s.closed() {
+		return nil, ErrSessionClosed
+	}
+
+	if !json.Valid(payload) {
+		return nil, ErrInvalidPayload
+	}
+
+	var timeout <-chan time.Time
+
+	if _, ok := ctx.Deadline(); !ok && s.melody.Config.RequestTimeout > 0 {
+		timer := s.melody.Config.Clock.NewTimer(s.melody.Config.RequestTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	id, reply, ok := s.requests.add()
+
+	if !ok {
+		return nil, ErrSessionClosed
+	}
+
+	defer s.requests.remove(id)
+
+	msg, err := json.Marshal(frame{ID: id, Data: payload})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Write(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case data, ok := <-reply:
+		if !ok {
+			return nil, ErrSessionClosed
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, context.DeadlineExceeded
+	}
+}
+
+// Call is a request sent by a client, see HandleCall.
+type Call struct {
+	ID      string // Correlation ID chosen by the client.
+	Data    []byte // JSON payload of the request.
+	session *Session
+}
+
+// Reply answers the call with payload as {"reply_to": ..., "data": payload}.
+// The payload must be valid JSON.
+func (c *Call) Reply(payload []byte) error {
+	if !json.Valid(payload) {
+		return ErrInvalidPayload
+	}
+
+	msg, err := json.Marshal(frame{ReplyTo: c.ID, Data: payload})
+
+	if err != nil {
+		return err
+	}
+
+	return c.session.Write(msg)
+}
@@ -0,0 +1,276 @@
+package melody
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ResumeEvent is the event written to a session as its first message when resumption is enabled,
+// see Config.ResumeWindow. Its data is a ResumeInfo.
+const ResumeEvent = "resume"
+
+// ResumeInfo is the data of the ResumeEvent. Every text and binary message written to the session
+// after it increases the sequence number by one, so that a client only has to count the messages it
+// receives. To resume, a client reconnects with the query parameters resume=<Token>&seq=<last seen
+// sequence number>, the missed messages are then replayed after the ResumeEvent and before any
+// other message.
+type ResumeInfo struct {
+	Token string `json:"token"`
+	Seq   uint64 `json:"seq"`
+}
+
+// resumption is the sequence number and history of a session, handed over to the session that resumes it.
+type resumption struct {
+	mu       sync.Mutex
+	token    string
+	owner    *Session // the session whose messages are recorded
+	seq      uint64   // sequence number of the last message in history
+	history  []envelope
+	pending  []envelope // written to the closed owner before its buffer was recorded
+	retained bool       // the buffer of the closed owner has been recorded
+	size     int
+	timer    Timer
+}
+
+func newResumption(s *Session) *resumption {
+	return &resumption{
+		token: randomID(),
+		owner: s,
+		size:  s.melody.Config.ResumeBufferSize,
+	}
+}
+
+// record assigns the next sequence number to message and keeps it for replay, unless s has been resumed or expired.
+func (r *resumption) record(s *Session, message envelope) bool {
+	if message.t != websocket.TextMessage && message.t != websocket.BinaryMessage {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.owner != s {
+		return false
+	}
+
+	r.add(message)
+
+	return true
+}
+
+// recordClosed records message written to s after it closed. Until the messages left in the
+// buffer of s have been recorded it is held back, so that it is not numbered before them. If s
+// has been resumed in the meantime, e.g. by a broadcast that picked s before it was resumed,
+// message is written to the session that resumed it instead.
+func (r *resumption) recordClosed(s *Session, message envelope) bool {
+	if message.t != websocket.TextMessage && message.t != websocket.BinaryMessage {
+		return false
+	}
+
+	r.mu.Lock()
+	owner := r.owner
+	if owner == s {
+		if r.retained {
+			r.add(message)
+		} else {
+			r.pending = append(r.pending, message)
+		}
+	}
+	r.mu.Unlock()
+
+	switch owner {
+	case s:
+		return true
+	case nil:
+		return false
+	}
+
+	owner.writeMessage(message)
+
+	return true
+}
+
+// retain records the messages held back by recordClosed once the buffer of s has been recorded.
+func (r *resumption) retain(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.owner != s {
+		return
+	}
+
+	for _, message := range r.pending {
+		r.add(message)
+	}
+
+	r.pending = nil
+	r.retained = true
+}
+
+// add assigns the next sequence number to message and keeps it for replay, r.mu must be held.
+func (r *resumption) add(message envelope) {
+	message.key = ""
+	message.filter = nil
+
+	r.seq++
+	r.history = append(r.history, message)
+	if len(r.history) > r.size {
+		r.history = r.history[len(r.history)-r.size:]
+	}
+}
+
+// since returns the messages after seq, or false if some of them are no longer kept.
+func (r *resumption) since(seq uint64) ([]envelope, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	missed := r.seq - seq
+
+	if seq > r.seq || missed > uint64(len(r.history)) {
+		return nil, false
+	}
+
+	return append([]envelope(nil), r.history[len(r.history)-int(missed):]...), true
+}
+
+// handover makes s the owner of the resumption.
+func (r *resumption) handover(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	r.owner = s
+	r.retained = false
+}
+
+// release drops the history once the resumption can no longer be resumed.
+func (r *resumption) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	r.owner = nil
+	r.history = nil
+	r.pending = nil
+}
+
+// resume registers s in place of the parked session the request asks to resume and returns the messages
+// to replay. A session that is still connected, e.g. because its client dropped without closing the
+// connection, is closed and parked first. It returns false if the request does not ask to resume or
+// the session can not be resumed.
+func (m *Melody) resume(s *Session) ([]envelope, uint64, bool) {
+	query := s.Request.URL.Query()
+
+	token := query.Get("resume")
+	if token == "" {
+		return nil, 0, false
+	}
+
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	if old, ok := m.hub.connected(token); ok {
+		if _, ok := old.resume.since(seq); ok {
+			old.terminate(CloseGoingAway, "session resumed", ErrSessionResumed)
+			<-old.detached
+		}
+	}
+
+	replay, ok := m.hub.resume(token, s, seq)
+	if !ok {
+		return nil, 0, false
+	}
+
+	return replay, seq, true
+}
+
+// inherit merges the keys of the parked session old into the keys of s, keys of s win.
+func (s *Session) inherit(old *Session) {
+	old.rwmutex.RLock()
+	defer old.rwmutex.RUnlock()
+
+	if len(old.Keys) == 0 {
+		return
+	}
+
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	keys := make(map[string]any, len(old.Keys)+len(s.Keys))
+	for key, value := range old.Keys {
+		keys[key] = value
+	}
+	for key, value := range s.Keys {
+		keys[key] = value
+	}
+	s.Keys = keys
+}
+
+// park keeps the history of s after it has disconnected for Config.ResumeWindow.
+func (m *Melody) park(s *Session) {
+	if !m.hub.park(s) {
+		s.resume.release()
+		return
+	}
+
+	s.resume.mu.Lock()
+	s.resume.timer = m.Config.Clock.AfterFunc(m.Config.ResumeWindow, func() {
+		if m.hub.expire(s) {
+			s.resume.release()
+		}
+	})
+	s.resume.mu.Unlock()
+}
+
+// greet writes the ResumeEvent followed by the replayed messages to the session.
+func (s *Session) greet(seq uint64, replay []envelope) error {
+	msg, err := encodeEvent(ResumeEvent, ResumeInfo{Token: s.resume.token, Seq: seq})
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeRaw(envelope{t: websocket.TextMessage, msg: msg}); err != nil {
+		return err
+	}
+
+	for _, message := range replay {
+		if err := s.writeRaw(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retainBuffered records the messages left in the buffer of a disconnected session for replay,
+// followed by the messages written to it since it closed.
+func (s *Session) retainBuffered() {
+	defer s.resume.retain(s)
+
+	for {
+		select {
+		case msg := <-s.output:
+			if msg.key != "" {
+				var ok bool
+				if msg, ok = s.uncoalesce(msg.key); !ok {
+					continue
+				}
+			}
+
+			s.resume.record(s, msg)
+		default:
+			return
+		}
+	}
+}
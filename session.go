@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -13,24 +14,58 @@ import (
 type Session struct {
 	Request    *http.Request
 	Keys       map[string]any
-	conn       *websocket.Conn
+	id         string
+	conn       Conn
 	output     chan envelope
 	outputDone chan struct{}
 	melody     *Melody
 	open       bool
 	rwmutex    sync.RWMutex
+	rooms      map[string]struct{} // guarded by melody.hub.mu
+	parked     bool                // disconnected and waiting to be resumed, guarded by melody.hub.mu
+	requests   requests
+	keyed      map[string]envelope
+	keyedMu    sync.Mutex
+	pingSent   atomic.Int64 // unix nanoseconds of the last ping
+	limiter    *limiter
+	ipLimiter  *limiter
+	inflight   chan struct{}
+	queue      []inbound
+	queueMu    sync.Mutex
+	draining   bool
+	principal  any
+	creds      credentials
+	compressed bool // permessage-deflate was negotiated
+	resume     *resumption
+	detached   chan struct{} // closed once the disconnected session has been parked, nil without resumption
+	lastActive atomic.Int64  // unix nanoseconds of the last message sent or received
+	reason     CloseReason   // guarded by rwmutex
+	overflowed atomic.Bool   // OverflowClose is closing the session
+	wire       *countingConn // counts bytes written to measure compression, nil if not measured
 }
 
 func (s *Session) writeMessage(message envelope) {
 	if s.closed() {
+		if s.resume != nil && s.resume.recordClosed(s, message) {
+			return
+		}
+
 		s.melody.errorHandler(s, ErrWriteClosed)
 		return
 	}
 
+	if s.melody.Config.OverflowPolicy == OverflowCoalesce && message.key != "" {
+		s.coalesce(message)
+		return
+	}
+
+	message.key = ""
+
 	select {
 	case s.output <- message:
+		s.buffered()
 	default:
-		s.melody.errorHandler(s, ErrMessageBufferFull)
+		s.overflow(message)
 	}
 }
 
@@ -39,13 +74,38 @@ func (s *Session) writeRaw(message envelope) error {
 		return ErrWriteClosed
 	}
 
-	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
-	err := s.conn.WriteMessage(message.t, message.msg)
+	var written int64
+	measure := false
+
+	if s.compressed && (message.t == websocket.TextMessage || message.t == websocket.BinaryMessage) {
+		compress := s.shouldCompress(message)
+		s.conn.(compressionWriter).EnableWriteCompression(compress)
+		if measure = compress && s.wire != nil; measure {
+			written = s.wire.written.Load()
+		}
+	}
+
+	s.conn.SetWriteDeadline(s.melody.now().Add(s.melody.Config.WriteWait))
+
+	var err error
+
+	if conn, ok := s.conn.(preparedWriter); ok && message.prepared != nil {
+		var pm *websocket.PreparedMessage
+		if pm, err = message.prepared.message(message.t, message.msg); err == nil {
+			err = conn.WritePreparedMessage(pm)
+		}
+	} else {
+		err = s.conn.WriteMessage(message.t, message.msg)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	if measure {
+		s.melody.Config.Metrics.MessageCompressed(len(message.msg), int(s.wire.written.Load()-written))
+	}
+
 	return nil
 }
 
@@ -64,24 +124,98 @@ func (s *Session) close() {
 	if open {
 		s.conn.Close()
 		close(s.outputDone)
+		s.requests.cancel()
 	}
 }
 
+// terminate writes a close message with code and text, bypassing the buffer, and closes the session
+// because of err.
+func (s *Session) terminate(code int, text string, err error) {
+	s.setCloseReason(CloseReason{Initiator: InitiatorServer, Code: code, Text: text, Err: err})
+	s.conn.WriteControl(websocket.CloseMessage, FormatCloseMessage(code, text), s.melody.now().Add(s.melody.Config.WriteWait))
+	s.close()
+}
+
 func (s *Session) ping() {
+	s.pingSent.Store(s.melody.now().UnixNano())
 	s.writeRaw(envelope{t: websocket.PingMessage, msg: []byte{}})
 }
 
 func (s *Session) writePump() {
-	ticker := time.NewTicker(s.melody.Config.PingPeriod)
+	ticker := s.melody.Config.Clock.NewTicker(s.melody.Config.PingPeriod)
 	defer ticker.Stop()
 
+	var credentialTimer Timer
+	var credentialCheck <-chan time.Time
+
+	resetCredentialTimer := func() {
+		if credentialTimer != nil {
+			credentialTimer.Stop()
+		}
+
+		credentialTimer, credentialCheck = nil, nil
+
+		if wait, ok := s.credentialWait(); ok {
+			credentialTimer = s.melody.Config.Clock.NewTimer(wait)
+			credentialCheck = credentialTimer.C()
+		}
+	}
+
+	resetCredentialTimer()
+
+	defer func() {
+		if credentialTimer != nil {
+			credentialTimer.Stop()
+		}
+	}()
+
+	s.active()
+
+	var idleTimer Timer
+	var idleCheck <-chan time.Time
+
+	if timeout := s.melody.Config.IdleTimeout; timeout > 0 {
+		idleTimer = s.melody.Config.Clock.NewTimer(timeout)
+		defer idleTimer.Stop()
+		idleCheck = idleTimer.C()
+	}
+
+	var lifetimeCheck <-chan time.Time
+
+	if lifetime := s.melody.lifetime(); lifetime > 0 {
+		lifetimeTimer := s.melody.Config.Clock.NewTimer(lifetime)
+		defer lifetimeTimer.Stop()
+		lifetimeCheck = lifetimeTimer.C()
+	}
+
 loop:
 	for {
 		select {
 		case msg := <-s.output:
+			if msg.key != "" {
+				var ok bool
+				if msg, ok = s.uncoalesce(msg.key); !ok {
+					continue
+				}
+			}
+
+			if msg.t == websocket.CloseMessage {
+				var err error
+				if s.melody.hub.closed() {
+					err = ErrClosed
+				}
+				s.setCloseReason(serverClose(msg.msg, err))
+			}
+
+			start := s.melody.now()
 			err := s.writeRaw(msg)
 
 			if err != nil {
+				if s.resume != nil {
+					s.resume.record(s, msg)
+				}
+
+				s.setCloseReason(CloseReason{Initiator: InitiatorNetwork, Code: CloseAbnormalClosure, Err: err})
 				s.melody.errorHandler(s, err)
 				break loop
 			}
@@ -90,15 +224,35 @@ loop:
 				break loop
 			}
 
-			if msg.t == websocket.TextMessage {
-				s.melody.messageSentHandler(s, msg.msg)
+			if s.resume != nil {
+				s.resume.record(s, msg)
 			}
 
-			if msg.t == websocket.BinaryMessage {
-				s.melody.messageSentHandlerBinary(s, msg.msg)
-			}
-		case <-ticker.C:
+			s.active()
+
+			s.melody.Config.Metrics.MessageSent(msg.t, len(msg.msg), s.melody.now().Sub(start))
+
+			s.sent(msg)
+		case <-ticker.C():
 			s.ping()
+		case <-s.creds.changed:
+			resetCredentialTimer()
+		case <-credentialCheck:
+			if s.checkCredentials() {
+				s.closeFor(ErrCredentialExpired, s.melody.Config.CredentialCloseCode, "credentials expired")
+				break loop
+			}
+			resetCredentialTimer()
+		case <-idleCheck:
+			if wait := s.idleWait(); wait > 0 {
+				idleTimer.Reset(wait)
+				continue
+			}
+			s.closeFor(ErrIdleTimeout, s.melody.Config.IdleCloseCode, "idle timeout")
+			break loop
+		case <-lifetimeCheck:
+			s.closeFor(ErrLifetimeExceeded, s.melody.Config.LifetimeCloseCode, "session lifetime exceeded")
+			break loop
 		case _, ok := <-s.outputDone:
 			if !ok {
 				break loop
@@ -109,18 +263,32 @@ loop:
 	s.close()
 }
 
+// closeFor reports err and writes a close message with code and text, the write pump stops after it.
+func (s *Session) closeFor(err error, code int, text string) {
+	s.melody.errorHandler(s, err)
+	s.setCloseReason(CloseReason{Initiator: InitiatorServer, Code: code, Text: text, Err: err})
+	s.writeRaw(envelope{t: websocket.CloseMessage, msg: FormatCloseMessage(code, text)})
+}
+
 func (s *Session) readPump() {
 	s.conn.SetReadLimit(s.melody.Config.MaxMessageSize)
-	s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
+	s.conn.SetReadDeadline(s.melody.now().Add(s.melody.Config.PongWait))
 
 	s.conn.SetPongHandler(func(string) error {
-		s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
+		defer s.recoverPanic()
+
+		s.conn.SetReadDeadline(s.melody.now().Add(s.melody.Config.PongWait))
+		if sent := s.pingSent.Load(); sent > 0 {
+			s.melody.Config.Metrics.Pong(s.melody.now().Sub(time.Unix(0, sent)))
+		}
 		s.melody.pongHandler(s)
 		return nil
 	})
 
 	if s.melody.closeHandler != nil {
-		s.conn.SetCloseHandler(func(code int, text string) error {
+		s.conn.SetCloseHandler(func(code int, text string) (err error) {
+			defer s.recoverPanic()
+
 			return s.melody.closeHandler(s, code, text)
 		})
 	}
@@ -129,11 +297,26 @@ func (s *Session) readPump() {
 		t, message, err := s.conn.ReadMessage()
 
 		if err != nil {
+			s.setCloseReason(readClose(err))
 			s.melody.errorHandler(s, err)
 			break
 		}
 
-		if s.melody.Config.ConcurrentMessageHandling {
+		s.melody.Config.Metrics.MessageReceived(t, len(message))
+
+		s.active()
+
+		if !s.limit(len(message)) {
+			continue
+		}
+
+		if t == websocket.TextMessage && s.requests.resolve(message) {
+			continue
+		}
+
+		if s.melody.Config.WorkerPoolSize > 0 {
+			s.schedule(t, message)
+		} else if s.melody.Config.ConcurrentMessageHandling {
 			go s.handleMessage(t, message)
 		} else {
 			s.handleMessage(t, message)
@@ -144,9 +327,27 @@ func (s *Session) readPump() {
 func (s *Session) handleMessage(t int, message []byte) {
 	switch t {
 	case websocket.TextMessage:
-		s.melody.messageHandler(s, message)
+		s.handle(EventMessage, message)
+	case websocket.BinaryMessage:
+		s.handle(EventMessageBinary, message)
+	}
+}
+
+// handle passes an event through the middleware chain to the handlers.
+func (s *Session) handle(kind EventKind, message []byte) {
+	defer s.recoverPanic()
+
+	s.melody.handler(s, kind, message)
+}
+
+func (s *Session) sent(message envelope) {
+	defer s.recoverPanic()
+
+	switch message.t {
+	case websocket.TextMessage:
+		s.melody.messageSentHandler(s, message.msg)
 	case websocket.BinaryMessage:
-		s.melody.messageHandlerBinary(s, message)
+		s.melody.messageSentHandlerBinary(s, message.msg)
 	}
 }
 
@@ -195,6 +396,45 @@ func (s *Session) CloseWithMsg(msg []byte) error {
 	return nil
 }
 
+// ID returns the unique identifier of the session.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Join adds the session to room. Rooms are created on first join and
+// removed when their last session leaves. A session leaves all of its
+// rooms automatically when it disconnects.
+func (s *Session) Join(room string) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	if !s.melody.hub.join(s, room) {
+		return ErrSessionClosed
+	}
+
+	s.melody.presence.join(s, room)
+
+	return nil
+}
+
+// Leave removes the session from room.
+func (s *Session) Leave(room string) error {
+	if s.closed() {
+		return ErrSessionClosed
+	}
+
+	s.melody.hub.part(s, room)
+	s.melody.presence.leave(s, room)
+
+	return nil
+}
+
+// Rooms returns the rooms the session is a member of.
+func (s *Session) Rooms() []string {
+	return s.melody.hub.sessionRooms(s)
+}
+
 // Set is used to store a new key/value pair exclusively for this session.
 // It also lazy initializes s.Keys if it was not used previously.
 func (s *Session) Set(key string, value any) {
@@ -254,8 +494,15 @@ func (s *Session) RemoteAddr() net.Addr {
 	return s.conn.RemoteAddr()
 }
 
+// Conn returns the connection of the session.
+func (s *Session) Conn() Conn {
+	return s.conn
+}
+
 // WebsocketConnection returns the underlying websocket connection.
 // This can be used to e.g. set/read additional websocket options or to write sychronous messages.
+// It returns nil for sessions whose connection is not a *websocket.Conn, see HandleConn and HandleTransport.
 func (s *Session) WebsocketConnection() *websocket.Conn {
-	return s.conn
+	conn, _ := s.conn.(*websocket.Conn)
+	return conn
 }
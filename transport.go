@@ -0,0 +1,522 @@
+package melody
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Fallback transports for clients that can not open a websocket, see Melody.HandleTransport.
+const (
+	TransportSSE  = "sse"  // Server-sent events downstream, HTTP POST upstream.
+	TransportPoll = "poll" // Long-polling downstream, HTTP POST upstream.
+)
+
+// TransportFrame is a message written to a session connected with a fallback transport.
+// Type is "text", "binary" or "close". Data is the message, base64 encoded for binary
+// messages and the close text for close messages, Code is the close code.
+type TransportFrame struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Code int    `json:"code,omitempty"`
+}
+
+func newTransportFrame(t int, data []byte) (TransportFrame, bool) {
+	switch t {
+	case websocket.TextMessage:
+		return TransportFrame{Type: "text", Data: string(data)}, true
+	case websocket.BinaryMessage:
+		return TransportFrame{Type: "binary", Data: base64.StdEncoding.EncodeToString(data)}, true
+	case websocket.CloseMessage:
+		frame := TransportFrame{Type: "close", Code: websocket.CloseNoStatusReceived}
+		if len(data) >= 2 {
+			frame.Code = int(binary.BigEndian.Uint16(data))
+			frame.Data = string(data[2:])
+		}
+		return frame, true
+	}
+
+	return TransportFrame{}, false
+}
+
+// transports are the open fallback transport connections by token.
+type transports struct {
+	mu    sync.Mutex
+	conns map[string]*transportConn
+}
+
+func (t *transports) add(c *transportConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns == nil {
+		t.conns = make(map[string]*transportConn)
+	}
+
+	t.conns[c.token] = c
+}
+
+func (t *transports) get(token string) (*transportConn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.conns[token]
+	return c, ok
+}
+
+func (t *transports) remove(c *transportConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[c.token] == c {
+		delete(t.conns, c.token)
+	}
+}
+
+type inboundFrame struct {
+	t   int
+	msg []byte
+	err error
+}
+
+// transportAddr is the address of an http request.
+type transportAddr string
+
+func (a transportAddr) Network() string { return "tcp" }
+func (a transportAddr) String() string  { return string(a) }
+
+// transportConn is the connection of a session using a fallback transport.
+type transportConn struct {
+	melody  *Melody
+	token   string
+	kind    string
+	w       http.ResponseWriter // event stream of TransportSSE
+	flusher http.Flusher
+	gone    <-chan struct{} // closed when the client of TransportSSE goes away
+	local   net.Addr
+	remote  net.Addr
+	inbound chan inboundFrame
+	ready   chan struct{}
+	done    chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	frames   []TransportFrame // waiting for a poll with TransportPoll
+	deadline time.Time
+	limit    int64
+	pong     func(string) error
+	onClose  func(int, string) error
+}
+
+func newTransportConn(m *Melody, kind string, w http.ResponseWriter, r *http.Request) *transportConn {
+	c := &transportConn{
+		melody:  m,
+		token:   randomID(),
+		kind:    kind,
+		remote:  transportAddr(r.RemoteAddr),
+		inbound: make(chan inboundFrame),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+
+	if kind == TransportSSE {
+		c.w = w
+		c.flusher, _ = w.(http.Flusher)
+		c.gone = r.Context().Done()
+	}
+
+	return c
+}
+
+func (c *transportConn) ReadMessage() (int, []byte, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		var timer Timer
+		var timeout <-chan time.Time
+
+		if !deadline.IsZero() {
+			timer = c.melody.Config.Clock.NewTimer(deadline.Sub(c.melody.now()))
+			timeout = timer.C()
+		}
+
+		select {
+		case in := <-c.inbound:
+			stopTimer(timer)
+			return in.t, in.msg, in.err
+		case <-c.done:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-c.gone:
+			stopTimer(timer)
+			return 0, nil, &websocket.CloseError{Code: websocket.CloseGoingAway}
+		case <-timeout:
+			c.mu.Lock()
+			extended := !c.deadline.Equal(deadline)
+			c.mu.Unlock()
+
+			if !extended {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+		}
+	}
+}
+
+func stopTimer(timer Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (c *transportConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+
+	frame, ok := newTransportFrame(messageType, data)
+
+	if c.kind == TransportPoll {
+		if ok {
+			c.frames = append(c.frames, frame)
+			c.wake()
+		}
+		c.mu.Unlock()
+		return nil
+	}
+
+	err := c.writeEvent(frame, ok)
+	pong := c.pong
+	c.mu.Unlock()
+
+	// A ping that reached the event stream counts as answered.
+	if err == nil && messageType == websocket.PingMessage && pong != nil {
+		return pong("")
+	}
+
+	return err
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// writeEvent writes frame to the event stream, or a comment keeping the stream alive if
+// there is no frame. c.mu must be held.
+func (c *transportConn) writeEvent(frame TransportFrame, ok bool) error {
+	var b strings.Builder
+
+	switch {
+	case !ok:
+		b.WriteString(": ping\n")
+	case frame.Type == "text":
+		// Event streams end lines at CRLF, CR or LF, so all of them become LF.
+		for _, line := range strings.Split(lineBreaks.Replace(frame.Data), "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	case frame.Type == "binary":
+		b.WriteString("event: binary\ndata: " + frame.Data + "\n")
+	default:
+		data, err := json.Marshal(frame)
+		if err != nil {
+			return err
+		}
+		b.WriteString("event: close\ndata: " + string(data) + "\n")
+	}
+
+	b.WriteString("\n")
+
+	if _, err := io.WriteString(c.w, b.String()); err != nil {
+		return err
+	}
+
+	c.flusher.Flush()
+
+	return nil
+}
+
+// wake signals a waiting poll, c.mu must be held.
+func (c *transportConn) wake() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *transportConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.WriteMessage(messageType, data)
+}
+
+func (c *transportConn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+}
+
+func (c *transportConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *transportConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *transportConn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pong = h
+	c.mu.Unlock()
+}
+
+func (c *transportConn) SetCloseHandler(h func(code int, text string) error) {
+	c.mu.Lock()
+	c.onClose = h
+	c.mu.Unlock()
+}
+
+func (c *transportConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	pending := len(c.frames) > 0
+	c.mu.Unlock()
+
+	// Keep the frames written before closing, typically the close frame, until the client polls.
+	if pending {
+		c.melody.Config.Clock.AfterFunc(c.melody.Config.PongWait, func() {
+			c.melody.transports.remove(c)
+		})
+		return nil
+	}
+
+	c.melody.transports.remove(c)
+
+	return nil
+}
+
+func (c *transportConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *transportConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// poll writes the frames waiting for the client, waiting up to Config.PollTimeout for one.
+// Every poll counts as a pong.
+func (c *transportConn) poll(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	pong := c.pong
+	c.mu.Unlock()
+
+	if pong != nil {
+		pong("")
+	}
+
+	timer := c.melody.Config.Clock.NewTimer(c.melody.Config.PollTimeout)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		frames, closed := c.frames, c.closed
+		c.frames = nil
+		c.mu.Unlock()
+
+		if len(frames) > 0 || closed {
+			if closed {
+				c.melody.transports.remove(c)
+			}
+			if frames == nil {
+				frames = []TransportFrame{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(frames)
+			return
+		}
+
+		select {
+		case <-c.ready:
+		case <-c.done:
+		case <-timer.C():
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "[]\n")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// post passes the request body to the session as a message, binary if the content type is
+// application/octet-stream and text otherwise.
+func (c *transportConn) post(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	limit := c.limit
+	c.mu.Unlock()
+
+	body := io.Reader(r.Body)
+	if limit > 0 {
+		body = io.LimitReader(r.Body, limit+1)
+	}
+
+	msg, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	in := inboundFrame{t: websocket.TextMessage, msg: msg}
+	status := http.StatusNoContent
+
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		in.t = websocket.BinaryMessage
+	}
+
+	if limit > 0 && int64(len(msg)) > limit {
+		in = inboundFrame{err: websocket.ErrReadLimit}
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	c.deliver(w, r, in, status)
+}
+
+// hangup closes the session on behalf of the client.
+func (c *transportConn) hangup(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	onClose := c.onClose
+	c.mu.Unlock()
+
+	if onClose != nil {
+		onClose(websocket.CloseNormalClosure, "")
+	}
+
+	c.deliver(w, r, inboundFrame{err: &websocket.CloseError{Code: websocket.CloseNormalClosure}}, http.StatusNoContent)
+}
+
+func (c *transportConn) deliver(w http.ResponseWriter, r *http.Request, in inboundFrame, status int) {
+	select {
+	case c.inbound <- in:
+		w.WriteHeader(status)
+	case <-c.done:
+		http.Error(w, ErrSessionClosed.Error(), http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+// HandleTransport handles http requests of clients that can not open a websocket. A client opens
+// a session with a GET request with the query parameter transport set to TransportSSE or
+// TransportPoll.
+//
+// With TransportSSE the response is an event stream of the session. Its first event is "open"
+// with the session token as data. Text messages are written as unnamed events, binary messages as
+// "binary" events with base64 encoded data and close messages as "close" events with a
+// TransportFrame as data.
+//
+// With TransportPoll the response is the JSON object {"sid": token}. The client then polls for
+// messages with GET requests with the query parameter sid set to the token, each responded to
+// with a JSON array of TransportFrame once there are messages or after Config.PollTimeout. A
+// client has to poll within Config.PongWait to stay connected.
+//
+// With both transports the client writes a message with a POST request with the query parameter
+// sid, a binary message if its content type is application/octet-stream and a text message
+// otherwise, and closes the session with a DELETE request. The token is the only credential of
+// these requests, it is not the session id.
+func (m *Melody) HandleTransport(w http.ResponseWriter, r *http.Request) error {
+	return m.HandleTransportWithKeys(w, r, nil)
+}
+
+// HandleTransportWithKeys does the same as HandleTransport but populates session.Keys with keys.
+func (m *Melody) HandleTransportWithKeys(w http.ResponseWriter, r *http.Request, keys map[string]any) error {
+	query := r.URL.Query()
+
+	// Requests of existing transports are served after Close and Shutdown, so that
+	// clients can collect the close message, posts are answered 410 Gone.
+	if token := query.Get("sid"); token != "" {
+		c, ok := m.transports.get(token)
+		if !ok {
+			http.Error(w, ErrSessionNotFound.Error(), http.StatusNotFound)
+			return ErrSessionNotFound
+		}
+
+		switch {
+		case r.Method == http.MethodGet && c.kind == TransportPoll:
+			c.poll(w, r)
+		case r.Method == http.MethodPost:
+			c.post(w, r)
+		case r.Method == http.MethodDelete:
+			c.hangup(w, r)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+
+		return nil
+	}
+
+	if m.hub.closed() {
+		http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+		return ErrClosed
+	}
+
+	kind := query.Get("transport")
+
+	if r.Method != http.MethodGet || (kind != TransportSSE && kind != TransportPoll) {
+		http.Error(w, ErrUnknownTransport.Error(), http.StatusBadRequest)
+		return ErrUnknownTransport
+	}
+
+	if _, ok := w.(http.Flusher); kind == TransportSSE && !ok {
+		http.Error(w, ErrUnknownTransport.Error(), http.StatusInternalServerError)
+		return ErrUnknownTransport
+	}
+
+	principal, err := m.authenticate(w, r)
+
+	if err != nil {
+		return err
+	}
+
+	conn := newTransportConn(m, kind, w, r)
+	session := m.newSession(r, keys, conn, principal)
+
+	m.transports.add(conn)
+
+	if kind == TransportPoll {
+		go func() {
+			if err := m.serve(session); err != nil {
+				m.errorHandler(session, err)
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(map[string]string{"sid": conn.token})
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "event: open\ndata: "+conn.token+"\n\n")
+	conn.flusher.Flush()
+
+	return m.serve(session)
+}